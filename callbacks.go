@@ -0,0 +1,269 @@
+package zsql
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrCallbackNameEmpty = errors.New("callback name can not be empty")
+	ErrCallbackNotFound  = errors.New("callback not found")
+	ErrCallbackCycle     = errors.New("callbacks have circular Before/After dependency")
+)
+
+// 内置回调，在其之前注册的回调可修改Statement，之后的可读取执行结果
+const (
+	CallbackQuery    = "zsql:query"
+	CallbackExec     = "zsql:exec"
+	CallbackCreate   = "zsql:create"
+	CallbackUpdate   = "zsql:update"
+	CallbackDelete   = "zsql:delete"
+	CallbackBegin    = "zsql:begin"
+	CallbackCommit   = "zsql:commit"
+	CallbackRollback = "zsql:rollback"
+)
+
+// Plugin 打包的扩展，通过DB.Use或Plugins选项安装
+type Plugin interface {
+	Name() string
+	Initialize(*DB) error
+}
+
+type callbacks struct {
+	processors map[string]*processor
+	mu         sync.Mutex
+	plugins    map[string]Plugin
+}
+
+func initializeCallbacks() *callbacks {
+	cs := &callbacks{
+		processors: make(map[string]*processor),
+		plugins:    make(map[string]Plugin),
+	}
+	for name, fn := range map[string]func(*DB){
+		CallbackQuery:    query,
+		CallbackExec:     exec,
+		CallbackCreate:   exec,
+		CallbackUpdate:   exec,
+		CallbackDelete:   exec,
+		CallbackBegin:    begin,
+		CallbackCommit:   commit,
+		CallbackRollback: rollback,
+	} {
+		p := &processor{}
+		if err := p.Register(name, fn); err != nil {
+			panic(err)
+		}
+		cs.processors[name] = p
+	}
+	return cs
+}
+
+// Callback 回调注册入口，如
+//
+//	db.Callback().Query().Before(zsql.CallbackQuery).Register("tenant", fn)
+func (db *DB) Callback() *callbacks {
+	return db.callbacks
+}
+
+// Use 安装插件，同名插件只能安装一次
+func (db *DB) Use(plugin Plugin) error {
+	cs := db.callbacks
+	name := plugin.Name()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.plugins[name]; ok {
+		return fmt.Errorf("plugin %s already registered", name)
+	}
+	if err := plugin.Initialize(db); err != nil {
+		return err
+	}
+	cs.plugins[name] = plugin
+	return nil
+}
+
+func (cs *callbacks) Query() *processor {
+	return cs.processors[CallbackQuery]
+}
+
+func (cs *callbacks) Exec() *processor {
+	return cs.processors[CallbackExec]
+}
+
+func (cs *callbacks) Create() *processor {
+	return cs.processors[CallbackCreate]
+}
+
+func (cs *callbacks) Update() *processor {
+	return cs.processors[CallbackUpdate]
+}
+
+func (cs *callbacks) Delete() *processor {
+	return cs.processors[CallbackDelete]
+}
+
+func (cs *callbacks) Begin() *processor {
+	return cs.processors[CallbackBegin]
+}
+
+func (cs *callbacks) Commit() *processor {
+	return cs.processors[CallbackCommit]
+}
+
+func (cs *callbacks) Rollback() *processor {
+	return cs.processors[CallbackRollback]
+}
+
+// processor 注册、删除及替换可在运行时与Execute并发进行，
+// 正在执行的语句使用修改前的回调
+type processor struct {
+	mu        sync.RWMutex
+	callbacks []*callback
+	fns       []func(*DB)
+}
+
+type callback struct {
+	name      string
+	before    string
+	after     string
+	handler   func(*DB)
+	processor *processor
+}
+
+// Execute 按顺序执行回调，出错后仍会继续执行，回调自行检查db.Error
+func (p *processor) Execute(db *DB) *DB {
+	p.mu.RLock()
+	fns := p.fns
+	p.mu.RUnlock()
+	for _, fn := range fns {
+		fn(db)
+	}
+	return db
+}
+
+// Before 注册的回调将在name之前执行
+func (p *processor) Before(name string) *callback {
+	return &callback{before: name, processor: p}
+}
+
+// After 注册的回调将在name之后执行
+func (p *processor) After(name string) *callback {
+	return &callback{after: name, processor: p}
+}
+
+// Register 未指定顺序的回调按注册顺序排在最后
+func (p *processor) Register(name string, fn func(*DB)) error {
+	return (&callback{processor: p}).Register(name, fn)
+}
+
+func (p *processor) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for idx, c := range p.callbacks {
+		if c.name == name {
+			callbacks := append(append([]*callback{}, p.callbacks[:idx]...), p.callbacks[idx+1:]...)
+			return p.compile(callbacks)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrCallbackNotFound, name)
+}
+
+func (p *processor) Replace(name string, fn func(*DB)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for idx, c := range p.callbacks {
+		if c.name == name {
+			callbacks := append([]*callback{}, p.callbacks...)
+			replaced := *c
+			replaced.handler = fn
+			callbacks[idx] = &replaced
+			return p.compile(callbacks)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrCallbackNotFound, name)
+}
+
+func (c *callback) Before(name string) *callback {
+	c.before = name
+	return c
+}
+
+func (c *callback) After(name string) *callback {
+	c.after = name
+	return c
+}
+
+func (c *callback) Register(name string, fn func(*DB)) error {
+	if name == "" {
+		return ErrCallbackNameEmpty
+	}
+	p := c.processor
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, registered := range p.callbacks {
+		if registered.name == name {
+			return fmt.Errorf("callback %s already registered", name)
+		}
+	}
+	c.name = name
+	c.handler = fn
+	return p.compile(append(append([]*callback{}, p.callbacks...), c))
+}
+
+// compile 排序成功后才替换当前回调，调用方持有p.mu
+func (p *processor) compile(callbacks []*callback) error {
+	fns, err := sortCallbacks(callbacks)
+	if err != nil {
+		return err
+	}
+	p.callbacks = callbacks
+	p.fns = fns
+	return nil
+}
+
+// sortCallbacks 按Before/After拓扑排序，无约束的保持注册顺序，
+// 指向不存在回调的约束被忽略
+func sortCallbacks(callbacks []*callback) ([]func(*DB), error) {
+	index := make(map[string]int, len(callbacks))
+	for idx, c := range callbacks {
+		index[c.name] = idx
+	}
+	var (
+		edges    = make([][]int, len(callbacks))
+		inDegree = make([]int, len(callbacks))
+	)
+	for idx, c := range callbacks {
+		if target, ok := index[c.before]; ok && c.before != "" {
+			edges[idx] = append(edges[idx], target)
+			inDegree[target]++
+		}
+		if target, ok := index[c.after]; ok && c.after != "" {
+			edges[target] = append(edges[target], idx)
+			inDegree[idx]++
+		}
+	}
+
+	var (
+		fns  = make([]func(*DB), 0, len(callbacks))
+		done = make([]bool, len(callbacks))
+	)
+	for len(fns) < len(callbacks) {
+		next := -1
+		for idx := range callbacks {
+			if !done[idx] && inDegree[idx] == 0 {
+				next = idx
+				break
+			}
+		}
+		if next == -1 {
+			return nil, ErrCallbackCycle
+		}
+		done[next] = true
+		fns = append(fns, callbacks[next].handler)
+		for _, target := range edges[next] {
+			inDegree[target]--
+		}
+	}
+	return fns, nil
+}
@@ -0,0 +1,111 @@
+package zsql
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type registration struct {
+	name, before, after string
+}
+
+func register(p *processor, order *[]string, r registration) error {
+	c := &callback{processor: p, before: r.before, after: r.after}
+	return c.Register(r.name, func(*DB) {
+		*order = append(*order, r.name)
+	})
+}
+
+func TestCallbackOrder(t *testing.T) {
+	cases := []struct {
+		name          string
+		registrations []registration
+		expected      []string
+	}{
+		{"registration order", []registration{{name: "a"}, {name: "b"}, {name: "c"}}, []string{"a", "b", "c"}},
+		{"before", []registration{{name: "a"}, {name: "b"}, {name: "c", before: "a"}}, []string{"b", "c", "a"}},
+		{"after", []registration{{name: "a", after: "c"}, {name: "b"}, {name: "c"}}, []string{"b", "c", "a"}},
+		{"chain", []registration{{name: "a", after: "b"}, {name: "b", after: "c"}, {name: "c"}}, []string{"c", "b", "a"}},
+		{"before and after", []registration{{name: "a"}, {name: "b"}, {name: "c", before: "b", after: "a"}}, []string{"a", "c", "b"}},
+		{"missing target", []registration{{name: "a", before: "missing"}, {name: "b", after: "missing"}}, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		var order []string
+		p := &processor{}
+		for _, r := range c.registrations {
+			assert.Nil(t, register(p, &order, r), c.name)
+		}
+		p.Execute(&DB{})
+		assert.Equal(t, c.expected, order, c.name)
+	}
+}
+
+func TestCallbackCycle(t *testing.T) {
+	cases := []struct {
+		name          string
+		registrations []registration
+	}{
+		{"self", []registration{{name: "a", before: "a"}}},
+		{"pair", []registration{{name: "a", before: "b"}, {name: "b", before: "a"}}},
+		{"triangle", []registration{{name: "a", after: "c"}, {name: "b", after: "a"}, {name: "c", after: "b"}}},
+	}
+	for _, c := range cases {
+		var (
+			order []string
+			err   error
+		)
+		p := &processor{}
+		for _, r := range c.registrations {
+			if err = register(p, &order, r); err != nil {
+				break
+			}
+		}
+		assert.ErrorIs(t, err, ErrCallbackCycle, c.name)
+		// 排序失败时保留之前的回调
+		p.Execute(&DB{})
+		assert.Equal(t, len(c.registrations)-1, len(order), c.name)
+	}
+}
+
+func TestCallbackReplaceRemove(t *testing.T) {
+	var order []string
+	p := &processor{}
+	for _, r := range []registration{{name: "a"}, {name: "b", before: "a"}, {name: "c", after: "a"}} {
+		assert.Nil(t, register(p, &order, r))
+	}
+
+	assert.Nil(t, p.Replace("a", func(*DB) { order = append(order, "a2") }))
+	p.Execute(&DB{})
+	assert.Equal(t, []string{"b", "a2", "c"}, order)
+
+	order = nil
+	assert.Nil(t, p.Remove("b"))
+	p.Execute(&DB{})
+	assert.Equal(t, []string{"a2", "c"}, order)
+
+	assert.ErrorIs(t, p.Remove("b"), ErrCallbackNotFound)
+	assert.ErrorIs(t, p.Replace("missing", func(*DB) {}), ErrCallbackNotFound)
+	assert.EqualError(t, register(p, &order, registration{name: "a"}), "callback a already registered")
+	assert.ErrorIs(t, p.Register("", func(*DB) {}), ErrCallbackNameEmpty)
+}
+
+func TestCallbackConcurrentRegister(t *testing.T) {
+	p := &processor{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		name := string(rune('a' + i))
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, p.Register(name, func(*DB) {}))
+		}()
+		go func() {
+			defer wg.Done()
+			p.Execute(&DB{})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 8, len(p.callbacks))
+}
@@ -1,6 +1,7 @@
 package zsql
 
 import (
+	"reflect"
 	"strconv"
 	"strings"
 )
@@ -15,6 +16,8 @@ type Builder interface {
 	Writer
 	WriteQuoted(field interface{})
 	AddVar(vars ...interface{})
+	// AddFieldVar 同AddVar，并记录参数对应的列以便日志脱敏
+	AddFieldVar(field string, vars ...interface{})
 }
 
 // Clause
@@ -40,13 +43,30 @@ type IClause interface {
 	MergeClause(*Clause)
 }
 
-type orderByColumn struct {
+const (
+	NullsFirst = "FIRST"
+	NullsLast  = "LAST"
+)
+
+// OrderByColumn 排序列，Nulls为NullsFirst或NullsLast，mysql通过IS NULL排序模拟
+type OrderByColumn struct {
 	Column string
-	Desc   bool
+	// Expression 不为空时代替Column输出
+	Expression Expression
+	Desc       bool
+	Nulls      string
+}
+
+func (column OrderByColumn) writeTarget(builder Builder) {
+	if column.Expression != nil {
+		column.Expression.Build(builder)
+	} else {
+		builder.WriteQuoted(column.Column)
+	}
 }
 
 type orderBy struct {
-	Columns []orderByColumn
+	Columns []OrderByColumn
 }
 
 func (orderBy orderBy) Name() string {
@@ -54,23 +74,34 @@ func (orderBy orderBy) Name() string {
 }
 
 func (orderBy orderBy) Build(builder Builder) {
+	mysql := dialectOf(builder) == "mysql"
 	for idx, column := range orderBy.Columns {
 		if idx > 0 {
 			builder.WriteByte(',')
 		}
 
-		builder.WriteQuoted(column.Column)
+		if column.Nulls != "" && mysql {
+			column.writeTarget(builder)
+			if column.Nulls == NullsLast {
+				builder.WriteString(" IS NULL,")
+			} else {
+				builder.WriteString(" IS NOT NULL,")
+			}
+		}
+		column.writeTarget(builder)
 		if column.Desc {
 			builder.WriteString(" DESC")
 		}
+		if column.Nulls != "" && !mysql {
+			builder.WriteString(" NULLS " + column.Nulls)
+		}
 	}
 }
 
+// MergeClause 按调用顺序追加排序列
 func (ob orderBy) MergeClause(clause *Clause) {
 	if v, ok := clause.Expression.(orderBy); ok {
-		copiedColumns := make([]orderByColumn, len(v.Columns))
-		copy(copiedColumns, v.Columns)
-		ob.Columns = append(ob.Columns, copiedColumns...)
+		ob.Columns = append(append([]OrderByColumn{}, v.Columns...), ob.Columns...)
 	}
 
 	clause.Expression = ob
@@ -147,6 +178,56 @@ func (limit Limit) MergeClause(clause *Clause) {
 	clause.Expression = limit
 }
 
+const (
+	LockingStrengthUpdate    = "UPDATE"
+	LockingStrengthShare     = "SHARE"
+	LockingOptionsSkipLocked = "SKIP LOCKED"
+	LockingOptionsNoWait     = "NOWAIT"
+)
+
+// Locking 行锁，如 FOR UPDATE OF t SKIP LOCKED，只能在事务中使用
+type Locking struct {
+	Strength string
+	// Table OF 指定锁定的表
+	Table   string
+	Options string
+}
+
+func (locking Locking) Name() string {
+	return "FOR"
+}
+
+func (locking Locking) Build(builder Builder) {
+	// mysql 5.7不支持FOR SHARE，没有额外选项时使用等价写法
+	if locking.Strength == LockingStrengthShare && locking.Table == "" && locking.Options == "" && dialectOf(builder) == "mysql" {
+		builder.WriteString("LOCK IN SHARE MODE")
+		return
+	}
+	builder.WriteString("FOR ")
+	builder.WriteString(locking.Strength)
+	if locking.Table != "" {
+		builder.WriteString(" OF ")
+		builder.WriteQuoted(tableName(locking.Table))
+	}
+	if locking.Options != "" {
+		builder.WriteByte(' ')
+		builder.WriteString(locking.Options)
+	}
+}
+
+func (locking Locking) MergeClause(clause *Clause) {
+	clause.Name = ""
+	clause.Expression = locking
+}
+
+// dialectOf builder为Statement时返回其数据库类型
+func dialectOf(builder Builder) string {
+	if d, ok := builder.(interface{ Dialect() string }); ok {
+		return d.Dialect()
+	}
+	return ""
+}
+
 type WhereEquality string
 
 const (
@@ -167,12 +248,39 @@ const (
 	WE_GTE     WhereEquality = ">="
 	WE_BETWEEN WhereEquality = "BETWEEN"
 	WE_IN      WhereEquality = "IN"
+	// not in
+	WE_NIN WhereEquality = "NOT IN"
+	// is null，不需要值
+	WE_NULL WhereEquality = "IS NULL"
+	// is not null，不需要值
+	WE_NOTNULL WhereEquality = "IS NOT NULL"
+	// 忽略大小写的like，mysql使用LOWER()模拟
+	WE_ILIKE WhereEquality = "ILIKE"
+	// not like
+	WE_NLK      WhereEquality = "NOT LIKE"
+	WE_NBETWEEN WhereEquality = "NOT BETWEEN"
+	// exists，值为子查询
+	WE_EXISTS WhereEquality = "EXISTS"
 )
 
 func (we WhereEquality) Equality() string {
 	return string(we)
 }
 
+// multiValue IN及BETWEEN类操作的值为切片
+func (we WhereEquality) multiValue() bool {
+	switch we {
+	case WE_IN, WE_NIN, WE_BETWEEN, WE_NBETWEEN:
+		return true
+	}
+	return false
+}
+
+// noValue IS NULL类操作不需要值
+func (we WhereEquality) noValue() bool {
+	return we == WE_NULL || we == WE_NOTNULL
+}
+
 func ToWhereEquality(op string) WhereEquality {
 	switch strings.ToUpper(op) {
 	case "=":
@@ -193,6 +301,20 @@ func ToWhereEquality(op string) WhereEquality {
 		return WE_BETWEEN
 	case "IN":
 		return WE_IN
+	case "NOT IN":
+		return WE_NIN
+	case "IS NULL":
+		return WE_NULL
+	case "IS NOT NULL":
+		return WE_NOTNULL
+	case "ILIKE":
+		return WE_ILIKE
+	case "NOT LIKE":
+		return WE_NLK
+	case "NOT BETWEEN":
+		return WE_NBETWEEN
+	case "EXISTS":
+		return WE_EXISTS
 	default:
 		return ""
 	}
@@ -223,25 +345,157 @@ func (where Where) Build(builder Builder) {
 
 func (where Where) MergeClause(clause *Clause) {
 	if v, ok := clause.Expression.(Where); ok {
-		copiedColumns := make([]WhereColumn, len(v.Columns))
-		copy(copiedColumns, v.Columns)
-		for _, column := range copiedColumns {
+		for _, column := range v.Columns {
 			if column.IsEmpty() {
 				panic("has empty WhereColumn")
-				continue
 			}
-			where.Columns = append(where.Columns, column)
 		}
-
+		where.Columns = mergeWhereColumns(v.Columns, where.Columns)
 	}
 	clause.Expression = where
 }
 
+// mergeWhereColumns 追加条件，AND与OR混用时将已有条件加括号，
+// 使新条件作用于之前的全部条件
+func mergeWhereColumns(exists, columns []WhereColumn) []WhereColumn {
+	if len(exists) > 1 && len(columns) > 0 {
+		connector := columns[0].name()
+		for _, column := range exists[1:] {
+			if column.name() != connector {
+				exists = []WhereColumn{&and{Columns: exists}}
+				break
+			}
+		}
+	}
+	return append(append([]WhereColumn{}, exists...), columns...)
+}
+
+// Having 分组后的过滤条件，与Where使用相同的条件树
+type Having struct {
+	Columns []WhereColumn
+}
+
+func (having Having) Name() string {
+	return "HAVING"
+}
+
+func (having Having) Build(builder Builder) {
+	Where(having).Build(builder)
+}
+
+func (having Having) MergeClause(clause *Clause) {
+	if v, ok := clause.Expression.(Having); ok {
+		having.Columns = mergeWhereColumns(v.Columns, having.Columns)
+	}
+	clause.Expression = having
+}
+
+type cte struct {
+	Name     string
+	SubQuery *DB
+}
+
+// with WITH子句，由Statement.Build置于语句最前，参数也排在最前
+type with struct {
+	Recursive bool
+	CTEs      []cte
+}
+
+func (with with) Name() string {
+	return "WITH"
+}
+
+func (with with) Build(builder Builder) {
+	builder.WriteString("WITH ")
+	if with.Recursive {
+		builder.WriteString("RECURSIVE ")
+	}
+	for idx, cte := range with.CTEs {
+		if idx > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(cte.Name)
+		builder.WriteString(" AS (")
+		buildSubQuery(builder, cte.SubQuery)
+		builder.WriteByte(')')
+	}
+}
+
+func (w with) MergeClause(clause *Clause) {
+	clause.Name = ""
+	if v, ok := clause.Expression.(with); ok {
+		w.Recursive = w.Recursive || v.Recursive
+		w.CTEs = append(append([]cte{}, v.CTEs...), w.CTEs...)
+	}
+	clause.Expression = w
+}
+
+type JoinType string
+
+const (
+	InnerJoin JoinType = "INNER"
+	LeftJoin  JoinType = "LEFT"
+	RightJoin JoinType = "RIGHT"
+)
+
+// Join 表连接，Expression不为空时按原样输出，
+// 否则由Type、Table及ON条件构建，ON中比较列时值使用Column
+type Join struct {
+	Type       JoinType
+	Table      string
+	ON         []WhereColumn
+	Expression string
+	Vars       []interface{}
+}
+
+func (join Join) Build(builder Builder) {
+	if join.Expression != "" {
+		builder.WriteString(join.Expression)
+		builder.AddVar(join.Vars...)
+		return
+	}
+	if join.Type != "" {
+		builder.WriteString(string(join.Type))
+		builder.WriteByte(' ')
+	}
+	builder.WriteString("JOIN ")
+	builder.WriteQuoted(tableName(join.Table))
+	if len(join.ON) > 0 {
+		builder.WriteString(" ON ")
+		Where{Columns: join.ON}.Build(builder)
+	}
+}
+
+type joins struct {
+	Joins []Join
+}
+
+func (joins joins) Name() string {
+	return "JOIN"
+}
+
+func (joins joins) Build(builder Builder) {
+	for idx, join := range joins.Joins {
+		if idx > 0 {
+			builder.WriteByte(' ')
+		}
+		join.Build(builder)
+	}
+}
+
+func (js joins) MergeClause(clause *Clause) {
+	clause.Name = ""
+	if v, ok := clause.Expression.(joins); ok {
+		js.Joins = append(append([]Join{}, v.Joins...), js.Joins...)
+	}
+	clause.Expression = js
+}
+
 func (where *Where) And(field string, quality WhereEquality, value interface{}) WhereColumn {
 	if quality.Equality() == "" {
 		panic("where builder and unsupported quality " + quality.Equality())
 	}
-	if quality == WE_IN || quality == WE_BETWEEN {
+	if quality.multiValue() {
 		if value == nil {
 			panic("where builder for quanlity in and between received empty value")
 		}
@@ -263,14 +517,12 @@ func And(field string, quality, value interface{}) WhereColumn {
 	case WhereEquality:
 		return &and{Field: field, Equality: v, Value: value}
 	case string:
-		s := WhereEquality(v)
-		if s.Equality() != "" {
-			return &and{Field: field, Equality: s, Value: value}
-		}
-		ts := ToWhereEquality(v)
-		if ts != "" {
+		if ts := ToWhereEquality(v); ts != "" {
 			return &and{Field: field, Equality: ts, Value: value}
 		}
+		if v != "" {
+			return &and{Field: field, Equality: WhereEquality(v), Value: value}
+		}
 	}
 	return &and{Field: ""}
 }
@@ -279,7 +531,7 @@ func (where *Where) Or(field string, quality WhereEquality, value interface{}) W
 	if quality.Equality() == "" {
 		panic("where builder and unsupported quality " + quality.Equality())
 	}
-	if quality == WE_IN || quality == WE_BETWEEN {
+	if quality.multiValue() {
 		if value == nil {
 			panic("where builder for quanlity in and between received empty value")
 		}
@@ -311,7 +563,7 @@ type and struct {
 }
 
 func (wc and) IsEmpty() bool {
-	return wc.Len() == 0 && wc.Field == "" && wc.Semantic == ""
+	return wc.Len() == 0 && wc.Field == "" && wc.Semantic == "" && wc.Equality == "" && wc.Value == nil
 }
 
 func (wc and) name() string {
@@ -322,8 +574,10 @@ func (wc *and) C(sub WhereColumn) {
 	if wc.Columns == nil {
 		wc.Columns = []WhereColumn{
 			&and{
-				Field: wc.Field,
-				Value: wc.Value,
+				Field:    wc.Field,
+				Equality: wc.Equality,
+				Semantic: wc.Semantic,
+				Value:    wc.Value,
 			},
 		}
 	}
@@ -354,35 +608,11 @@ func (wc and) build(builder Builder) {
 		wc.Columns[0].build(builder)
 		return
 	}
-	we := wc.Equality.Equality()
-	if we == "" {
-		if wc.Semantic == "" {
-			panic("equlity not support and sematic is empty")
-		}
-		builder.WriteString(" " + wc.Semantic)
-		vs := wc.Value.([]interface{})
-		builder.AddVar(vs...)
+	if wc.Equality.Equality() == "" {
+		buildSemantic(builder, wc.Semantic, wc.Value)
 		return
 	}
-	switch wc.Equality {
-	case WE_BETWEEN:
-		builder.WriteQuoted(wc.Field)
-		builder.WriteString(" " + we + " ? AND ?")
-		vs := wc.Value.([]interface{})
-		builder.AddVar(vs[0])
-		builder.AddVar(vs[1])
-	case WE_IN:
-		vs := wc.Value.([]interface{})
-		builder.WriteQuoted(wc.Field)
-		inClause := strings.Repeat("?,", len(vs))
-		builder.WriteString(" " + we + "(" + inClause[:len(inClause)-1] + ")")
-		builder.AddVar(vs...)
-	default:
-		builder.WriteQuoted(wc.Field)
-		builder.WriteString(" " + we + " ?")
-		builder.AddVar(wc.Value)
-	}
-
+	buildCondition(builder, wc.Field, wc.Equality, wc.Value)
 }
 
 type or struct {
@@ -398,15 +628,17 @@ func (wc or) name() string {
 }
 
 func (wc or) IsEmpty() bool {
-	return wc.Len() == 0 && wc.Field == "" && wc.Semantic == ""
+	return wc.Len() == 0 && wc.Field == "" && wc.Semantic == "" && wc.Equality == "" && wc.Value == nil
 }
 
 func (wc *or) C(sub WhereColumn) {
 	if wc.Columns == nil {
 		wc.Columns = []WhereColumn{
 			&or{
-				Field: wc.Field,
-				Value: wc.Value,
+				Field:    wc.Field,
+				Equality: wc.Equality,
+				Semantic: wc.Semantic,
+				Value:    wc.Value,
 			},
 		}
 	}
@@ -433,39 +665,216 @@ func (wc or) build(builder Builder) {
 		wc.Columns[0].build(builder)
 		return
 	}
-	we := wc.Equality.Equality()
-	if we == "" {
-		if wc.Semantic == "" {
+	if wc.Equality.Equality() == "" {
+		buildSemantic(builder, wc.Semantic, wc.Value)
+		return
+	}
+	buildCondition(builder, wc.Field, wc.Equality, wc.Value)
+}
+
+func (wc or) columns() []WhereColumn {
+	return wc.Columns
+}
+
+// AndGroup 将条件加括号作为整体，与之前的条件以AND连接
+func AndGroup(columns ...WhereColumn) WhereColumn {
+	return &and{Columns: columns}
+}
+
+// OrGroup 将条件加括号作为整体，与之前的条件以OR连接
+func OrGroup(columns ...WhereColumn) WhereColumn {
+	return &or{Columns: columns}
+}
+
+// Not 条件取反，生成 NOT (...)
+func Not(column WhereColumn) WhereColumn {
+	return &not{Column: column}
+}
+
+type not struct {
+	Column WhereColumn
+}
+
+func (wc not) name() string {
+	return "AND"
+}
+
+func (wc not) IsEmpty() bool {
+	return wc.Column == nil || wc.Column.IsEmpty()
+}
+
+func (wc *not) C(sub WhereColumn) {
+	wc.Column = &and{Columns: []WhereColumn{wc.Column, sub}}
+}
+
+// Len not作为整体输出，不展开子条件
+func (wc not) Len() int {
+	return 0
+}
+
+func (wc not) columns() []WhereColumn {
+	return nil
+}
+
+func (wc not) build(builder Builder) {
+	// 多个子条件时由其自身加括号
+	if wc.Column.Len() > 1 {
+		builder.WriteString("NOT ")
+		wc.Column.build(builder)
+		return
+	}
+	builder.WriteString("NOT (")
+	wc.Column.build(builder)
+	builder.WriteByte(')')
+}
+
+// buildSemantic 原生条件，Semantic为空时Value为Expression
+func buildSemantic(builder Builder, semantic string, value interface{}) {
+	if semantic == "" {
+		e, ok := value.(Expression)
+		if !ok {
 			panic("equlity not support and sematic is empty")
-			return
 		}
-		builder.WriteString(" " + wc.Semantic)
-		vs := wc.Value.([]interface{})
-		builder.AddVar(vs...)
+		e.Build(builder)
 		return
 	}
-	switch wc.Equality {
-	case WE_BETWEEN:
-		builder.WriteQuoted(wc.Field)
+	builder.WriteString(semantic)
+	vs := value.([]interface{})
+	builder.AddVar(vs...)
+}
+
+// buildCondition 构建单个条件，and与or共用
+func buildCondition(builder Builder, field string, equality WhereEquality, value interface{}) {
+	if isNil(value) {
+		// = NULL永远不成立
+		switch equality {
+		case WE_EQ:
+			equality = WE_NULL
+		case WE_NE:
+			equality = WE_NOTNULL
+		}
+	}
+	we := equality.Equality()
+	if e, ok := value.(Expression); ok && !equality.noValue() {
+		buildExpressionCondition(builder, field, equality, e)
+		return
+	}
+	if sub, ok := value.(*DB); ok {
+		if equality != WE_EXISTS {
+			builder.WriteQuoted(field)
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(we + " (")
+		buildSubQuery(builder, sub)
+		builder.WriteByte(')')
+		return
+	}
+	switch equality {
+	case WE_BETWEEN, WE_NBETWEEN:
+		builder.WriteQuoted(field)
 		builder.WriteString(" " + we + " ? AND ?")
-		vs := wc.Value.([]interface{})
-		builder.AddVar(vs[0])
-		builder.AddVar(vs[1])
-	case WE_IN:
-		vs := wc.Value.([]interface{})
-		builder.WriteQuoted(wc.Field)
-
+		vs := value.([]interface{})
+		builder.AddFieldVar(field, vs[0], vs[1])
+	case WE_IN, WE_NIN:
+		vs := value.([]interface{})
+		builder.WriteQuoted(field)
 		inClause := strings.Repeat("?,", len(vs))
 		builder.WriteString(" " + we + "(" + inClause[:len(inClause)-1] + ")")
-		builder.AddVar(vs...)
+		builder.AddFieldVar(field, vs...)
+	case WE_NULL, WE_NOTNULL:
+		builder.WriteQuoted(field)
+		builder.WriteString(" " + we)
+	case WE_ILIKE:
+		if dialectOf(builder) != "mysql" {
+			builder.WriteQuoted(field)
+			builder.WriteString(" ILIKE ?")
+		} else {
+			builder.WriteString("LOWER(")
+			builder.WriteQuoted(field)
+			builder.WriteString(") LIKE LOWER(?)")
+		}
+		builder.AddFieldVar(field, value)
 	default:
-		builder.WriteQuoted(wc.Field)
-		builder.WriteString(" " + we + " ?")
-		builder.AddVar(wc.Value)
+		builder.WriteQuoted(field)
+		builder.WriteString(" " + we + " ")
+		switch v := value.(type) {
+		case Column:
+			builder.WriteQuoted(string(v))
+			return
+		}
+		builder.WriteByte('?')
+		builder.AddFieldVar(field, value)
 	}
+}
 
+// buildExpressionCondition 值为Expression时原样输出，IN及EXISTS加括号，
+// BETWEEN时Expression需包含AND，如 Expr("? AND NOW()", from)
+func buildExpressionCondition(builder Builder, field string, equality WhereEquality, e Expression) {
+	switch equality {
+	case WE_EXISTS:
+		builder.WriteString("EXISTS (")
+		e.Build(builder)
+		builder.WriteByte(')')
+		return
+	case WE_ILIKE:
+		if dialectOf(builder) == "mysql" {
+			builder.WriteString("LOWER(")
+			builder.WriteQuoted(field)
+			builder.WriteString(") LIKE LOWER(")
+			e.Build(builder)
+			builder.WriteByte(')')
+			return
+		}
+	}
+	builder.WriteQuoted(field)
+	builder.WriteString(" " + equality.Equality() + " ")
+	if equality == WE_IN || equality == WE_NIN {
+		builder.WriteByte('(')
+		e.Build(builder)
+		builder.WriteByte(')')
+		return
+	}
+	e.Build(builder)
 }
 
-func (wc or) columns() []WhereColumn {
-	return wc.Columns
+// isNil 值为nil或nil指针
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
+// Column 作为条件的值时表示列而非参数，如JOIN的ON条件
+type Column string
+
+// Exists 子查询存在时成立
+func Exists(sub *DB) WhereColumn {
+	return &and{Equality: WE_EXISTS, Value: sub}
+}
+
+// buildSubQuery 将子查询语句及参数写入builder，子查询本身不受影响
+func buildSubQuery(builder Builder, sub *DB) {
+	st := sub.Statement
+	stmt := st.derive()
+	stmt.Vals = append([]interface{}{}, st.Vals...)
+	stmt.varColumns = append([]string{}, st.varColumns...)
+	stmt.SQL.WriteString(st.SQL.String())
+	clauses := st.BuildClauses
+	if clauses == nil {
+		clauses = sub.clausesCaller("SELECT")
+	}
+	stmt.Build(clauses...)
+	if outer, ok := builder.(*Statement); ok && sub.Error != nil {
+		outer.AddError(sub.Error)
+	}
+	builder.WriteString(stmt.SQL.String())
+	for idx, v := range stmt.Vals {
+		var column string
+		if idx < len(stmt.varColumns) {
+			column = stmt.varColumns[idx]
+		}
+		builder.AddFieldVar(column, v)
+	}
 }
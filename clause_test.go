@@ -0,0 +1,435 @@
+package zsql
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/luoskak/logger"
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/luoskak/zsql/pkg/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(dialect string) *DB {
+	return &DB{
+		dialect:       dialect,
+		clausesCaller: clausesDefaultCaller(dialect),
+		opts:          &mwOptions{cacheStore: &sync.Map{}, namingStrategy: schema.NamingStrategy{}},
+		clone:         1,
+		callbacks:     initializeCallbacks(),
+		log:           logger.NewLogger("test"),
+	}
+}
+
+// newFakeDB 读写均使用fakedb数据源的测试库
+func newFakeDB(handler fakedb.Handler) (*DB, *fakedb.Source) {
+	source := fakedb.New(handler)
+	db := newTestDB("mysql")
+	db.rConn = source.Open()
+	db.wConn = db.rConn
+	return db, source
+}
+
+func buildSQL(tx *DB) (string, []interface{}) {
+	tx.Statement.Build(tx.Statement.BuildClauses...)
+	return tx.Statement.SQL.String(), tx.Statement.Vals
+}
+
+func TestJoinHavingSubQuery(t *testing.T) {
+	db := newTestDB("postgres")
+	sub := db.Query("SELECT user_id FROM orders").Where("amount", ">", 100)
+	tx := db.Query("SELECT users.id, count(*) FROM users").
+		Joins(Join{Type: LeftJoin, Table: "orders o", ON: []WhereColumn{And("o.user_id", "=", Column("users.id")), And("o.state", "=", 1)}}).
+		Joins("LEFT JOIN tags t ON t.user_id = users.id AND t.name = ?", "vip").
+		Where("users.id", "IN", sub).
+		GroupBy("users.id").
+		Having(And("count(*)", ">", 3))
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT users.id, count(*) FROM users LEFT JOIN orders o ON o.user_id = users.id AND o.state = ? "+
+		"LEFT JOIN tags t ON t.user_id = users.id AND t.name = ? "+
+		"WHERE users.id IN (SELECT user_id FROM orders WHERE amount > ?) GROUP BY users.id HAVING count(*) > ?", sql)
+	assert.Equal(t, []interface{}{1, "vip", 100, 3}, vals)
+
+	// 子查询本身不受影响
+	sql, vals = buildSQL(sub)
+	assert.Equal(t, "SELECT user_id FROM orders WHERE amount > ?", sql)
+	assert.Equal(t, []interface{}{100}, vals)
+}
+
+func TestExists(t *testing.T) {
+	db := newTestDB("mysql")
+	tx := db.Query("SELECT * FROM users").Where(Exists(db.Query("SELECT 1 FROM bans").Where("bans.level", ">=", 2).Where("bans.user_id", "=", Column("users.id"))))
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE EXISTS (SELECT 1 FROM bans WHERE bans.level >= ? AND bans.user_id = users.id)", sql)
+	assert.Equal(t, []interface{}{2}, vals)
+}
+
+func TestWithRecursive(t *testing.T) {
+	db := newTestDB("postgres")
+	tree := db.Query("SELECT id, parent_id FROM categories WHERE id = ? UNION ALL SELECT c.id, c.parent_id FROM categories c JOIN tree t ON c.parent_id = t.id", 7)
+	tx := db.WithRecursive("tree(id, parent_id)", tree).
+		With("hidden", db.Query("SELECT category_id FROM hidden_categories").Where("scope", "=", "web")).
+		Query("SELECT * FROM tree").
+		Where("id", "<>", 9)
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "WITH RECURSIVE tree(id, parent_id) AS (SELECT id, parent_id FROM categories WHERE id = ? UNION ALL SELECT c.id, c.parent_id FROM categories c JOIN tree t ON c.parent_id = t.id),"+
+		"hidden AS (SELECT category_id FROM hidden_categories WHERE scope = ?) SELECT * FROM tree WHERE id <> ?", sql)
+	assert.Equal(t, []interface{}{7, "web", 9}, vals)
+}
+
+func TestUnion(t *testing.T) {
+	db := newTestDB("mysql")
+	tx := db.UnionAll(
+		db.Query("SELECT id, name FROM users").Where("state", "=", 1),
+		db.Query("SELECT id, name FROM admins").Where("level", ">", 2).Limit(5),
+	).Order("name").Limit(10)
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "(SELECT id, name FROM users WHERE state = ?) UNION ALL (SELECT id, name FROM admins WHERE level > ? LIMIT 5) ORDER BY name LIMIT 10", sql)
+	assert.Equal(t, []interface{}{1, 2}, vals)
+}
+
+func TestExpr(t *testing.T) {
+	db := newTestDB("mysql")
+	tx := db.Query("SELECT * FROM users").
+		Where("updated_at", ">", Expr("NOW() - INTERVAL ? DAY", 1)).
+		Where("a.x", "=", Column("b.y")).
+		Order(Expr("FIELD(id, ?, ?)", 3, 5))
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE updated_at > NOW() - INTERVAL ? DAY AND a.x = b.y ORDER BY FIELD(id, ?, ?)", sql)
+	assert.Equal(t, []interface{}{1, 3, 5}, vals)
+}
+
+// jsonPath 自定义Expression，使用WriteQuoted输出列名
+type jsonPath struct {
+	Column string
+	Path   string
+}
+
+func (p jsonPath) Build(builder Builder) {
+	builder.WriteQuoted(p.Column)
+	builder.WriteString("->>?")
+	builder.AddVar(p.Path)
+}
+
+func TestCustomExpression(t *testing.T) {
+	db := newTestDB("postgres")
+	tx := db.Query("SELECT * FROM users").
+		Where(jsonPath{Column: "profile", Path: "city"}).
+		Where("id", "IN", Expr("SELECT user_id FROM orders WHERE amount > ?", 100)).
+		Where("created_at", WE_BETWEEN, Expr("? AND NOW()", "2024-01-01")).
+		Where("name", "=", jsonPath{Column: "profile", Path: "name"}).
+		AddNameMap("profile", "u.profile").
+		Order(jsonPath{Column: "profile", Path: "age"})
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE u.profile->>? AND id IN (SELECT user_id FROM orders WHERE amount > ?) "+
+		"AND created_at BETWEEN ? AND NOW() AND name = u.profile->>? ORDER BY u.profile->>?", sql)
+	assert.Equal(t, []interface{}{"city", 100, "2024-01-01", "name", "age"}, vals)
+
+	tx = db.Query("SELECT * FROM users").Where(map[string]interface{}{
+		"id":   map[string]interface{}{"NOT IN": Expr("SELECT user_id FROM bans")},
+		"name": map[string]interface{}{"ILIKE": Expr("?", "%a%")},
+	})
+	sql, vals = buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE id NOT IN (SELECT user_id FROM bans) AND name ILIKE ?", sql)
+	assert.Equal(t, []interface{}{"%a%"}, vals)
+}
+
+func TestWhereEqualities(t *testing.T) {
+	var deletedAt *string
+	for dialect, expected := range map[string]string{
+		"postgres": "SELECT * FROM users WHERE parent_id IS NULL AND banned_at IS NOT NULL AND age NOT BETWEEN ? AND ? AND email NOT LIKE ? AND state NOT IN(?,?) AND deleted_at IS NULL AND name ILIKE ?",
+		"mysql":    "SELECT * FROM users WHERE parent_id IS NULL AND banned_at IS NOT NULL AND age NOT BETWEEN ? AND ? AND email NOT LIKE ? AND state NOT IN(?,?) AND deleted_at IS NULL AND LOWER(name) LIKE LOWER(?)",
+	} {
+		db := newTestDB(dialect)
+		tx := db.Query("SELECT * FROM users").
+			Where("parent_id", "IS NULL").
+			Where("banned_at", WE_NE, nil).
+			Where("age", "NOT BETWEEN", []interface{}{18, 60}).
+			Where("email", WE_NLK, "%@test.com").
+			Where("state", "not in", []interface{}{2, 3}).
+			Where("deleted_at", "=", deletedAt).
+			Where("name", WE_ILIKE, "%Tom%")
+
+		sql, vals := buildSQL(tx)
+		assert.Equal(t, expected, sql, dialect)
+		assert.Equal(t, []interface{}{18, 60, "%@test.com", 2, 3, "%Tom%"}, vals, dialect)
+	}
+}
+
+func TestWhereNullLikeValues(t *testing.T) {
+	db := newTestDB("mysql")
+	tx := db.Query("SELECT * FROM users").
+		Where("name = ?", "null").
+		Where("note <> ?", "is null").
+		Where("state = ?", "IS NOT NULL").
+		Where("a.deleted_at", "is null").
+		Where("LOWER(email)", WE_NOTNULL)
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE name = ? AND note <> ? AND state = ? AND a.deleted_at IS NULL AND LOWER(email) IS NOT NULL", sql)
+	assert.Equal(t, []interface{}{"null", "is null", "IS NOT NULL"}, vals)
+
+	for _, alias := range []string{"NULL", "NOTNULL", "NOT NULL", "NIN", "NLK", "NBETWEEN"} {
+		assert.Equal(t, WhereEquality(""), ToWhereEquality(alias), alias)
+	}
+}
+
+func TestOrNot(t *testing.T) {
+	db := newTestDB("mysql")
+	group := And("a", "=", 1)
+	group.C(And("b", "=", 2))
+	tx := db.Query("SELECT * FROM users").
+		Where("state", "=", 1).
+		Where("age", ">", 18).
+		Or("role", "=", "admin").
+		Not("name", "LIKE", "test%").
+		Where(Not(group))
+
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE ((state = ? AND age > ?) OR role = ?) AND NOT (name LIKE ?) AND NOT (a = ? AND b = ?)", sql)
+	assert.Equal(t, []interface{}{1, 18, "admin", "test%", 1, 2}, vals)
+}
+
+type whereUser struct {
+	ID    int64
+	Name  string
+	Age   int
+	Admin bool
+}
+
+func TestStructAndMapWhere(t *testing.T) {
+	db := newTestDB("mysql")
+	db.opts.cacheStore = &sync.Map{}
+	db.opts.namingStrategy = schema.NamingStrategy{}
+
+	tx := db.Query("SELECT * FROM where_users").Where(&whereUser{Name: "a", Age: 3}, "Admin")
+	sql, vals := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM where_users WHERE name = ? AND age = ? AND admin = ?", sql)
+	assert.Equal(t, []interface{}{"a", 3, false}, vals)
+
+	tx = db.Query("SELECT * FROM where_users").Where(map[string]interface{}{
+		"name":       "a",
+		"id":         []int{1, 2},
+		"deleted_at": nil,
+		"age":        map[string]interface{}{">": 3},
+	})
+	sql, vals = buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM where_users WHERE age > ? AND deleted_at IS NULL AND id IN(?,?) AND name = ?", sql)
+	assert.Equal(t, []interface{}{3, 1, 2, "a"}, vals)
+}
+
+func TestStrictIdentifiers(t *testing.T) {
+	db := newTestDB("postgres")
+	db.opts.cacheStore = &sync.Map{}
+	db.opts.namingStrategy = schema.NamingStrategy{}
+	sc, err := schema.Parse(&whereUser{}, db.opts.cacheStore, db.opts.namingStrategy)
+	assert.Nil(t, err)
+
+	tx := db.Query("SELECT * FROM where_users").Strict("count(*)").
+		Where("where_users.age", ">", 3).
+		GroupBy("name").
+		Order("id DESC NULLS LAST").
+		Order("count(*)")
+	tx.Statement.Schema = sc
+	tx.Statement.Table = "where_users"
+	sql, _ := buildSQL(tx)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, `SELECT * FROM where_users WHERE "where_users"."age" > ? GROUP BY "name" ORDER BY "id" DESC NULLS LAST,count(*)`, sql)
+
+	tx = db.Query("SELECT * FROM where_users").Strict().Order("name; DROP TABLE where_users")
+	tx.Statement.Schema = sc
+	buildSQL(tx)
+	var identifierErr *IdentifierError
+	assert.ErrorIs(t, tx.Error, ErrInvalidIdentifier)
+	assert.ErrorAs(t, tx.Error, &identifierErr)
+	assert.Equal(t, "name; DROP TABLE where_users", identifierErr.Identifier)
+}
+
+func TestOrderNulls(t *testing.T) {
+	db := newTestDB("mysql")
+	tx := db.Query("SELECT * FROM users").Order([][]string{{"name", "DESC", "NULLS FIRST"}, {"id", "ASC", "NULLS LAST"}})
+	sql, _ := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users ORDER BY name IS NOT NULL,name DESC,id IS NULL,id", sql)
+
+	tx = db.Query("SELECT * FROM users").Order("run_at").Order(OrderByColumn{Column: "priority", Desc: true}).Order("id")
+	sql, _ = buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users ORDER BY run_at,priority DESC,id", sql)
+}
+
+func TestPaginateSQL(t *testing.T) {
+	db := newTestDB("mysql")
+	tx := db.Query("SELECT user_id, count(*) FROM orders").Where("state", "=", 1).GroupBy("user_id").
+		Having(And("count(*)", ">", 2)).Order("user_id DESC").Limit(5)
+	sql, vals := tx.countSQL()
+	assert.Equal(t, "SELECT COUNT(*) FROM (SELECT user_id, count(*) FROM orders WHERE state = ? GROUP BY user_id HAVING count(*) > ?) zsql_count", sql)
+	assert.Equal(t, []interface{}{1, 2}, vals)
+
+	// 原语句不受影响
+	sql, _ = buildSQL(tx)
+	assert.Equal(t, "SELECT user_id, count(*) FROM orders WHERE state = ? GROUP BY user_id HAVING count(*) > ? ORDER BY user_id DESC LIMIT 5", sql)
+
+	sql, ok := withWindowTotal("SELECT id, (SELECT name FROM tags WHERE tags.id = tag_id) AS tag\nFROM users WHERE note = ' from '")
+	assert.True(t, ok)
+	assert.Equal(t, "SELECT id, (SELECT name FROM tags WHERE tags.id = tag_id) AS tag, COUNT(*) OVER() AS zsql_total FROM users WHERE note = ' from '", sql)
+	_, ok = withWindowTotal("SELECT DISTINCT user_id FROM orders")
+	assert.False(t, ok)
+	_, ok = withWindowTotal("(SELECT id FROM a) UNION (SELECT id FROM b)")
+	assert.False(t, ok)
+
+	page := Page{Page: 2, PerPage: 10}.withTotal(21)
+	assert.Equal(t, Page{Page: 2, PerPage: 10, Total: 21, Pages: 3, HasNext: true}, page)
+	page = Page{Page: 3, PerPage: 10}.withTotal(21)
+	assert.False(t, page.HasNext)
+
+	_, err := db.Query("SELECT * FROM users").Paginate(1, 0, &[]whereUser{})
+	assert.ErrorIs(t, err, ErrInvalidPerPage)
+}
+
+func TestCursorCondition(t *testing.T) {
+	db := newTestDB("postgres")
+	db.opts.cacheStore = &sync.Map{}
+	db.opts.namingStrategy = schema.NamingStrategy{}
+	sc, err := schema.Parse(&whereUser{}, db.opts.cacheStore, db.opts.namingStrategy)
+	assert.Nil(t, err)
+
+	tx := db.Query("SELECT * FROM users").Order([][]string{{"u.age", "DESC"}, {"id", "ASC"}})
+	keys, err := tx.cursorKeys(sc)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	token, err := encodeCursor(reflect.ValueOf(&whereUser{ID: 7, Age: 30}), keys)
+	assert.Nil(t, err)
+	values, err := decodeCursor(token, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{30, int64(7)}, values)
+
+	sql, vals := buildSQL(db.Query("SELECT * FROM users").Where("admin", "=", true).Where(seekCondition(keys, values, false, false)))
+	assert.Equal(t, "SELECT * FROM users WHERE admin = ? AND (u.age < ? OR (u.age = ? AND id > ?))", sql)
+	assert.Equal(t, []interface{}{true, 30, 30, int64(7)}, vals)
+
+	sql, _ = buildSQL(db.Query("SELECT * FROM users").Where(seekCondition(keys, values, true, true)))
+	assert.Equal(t, "SELECT * FROM users WHERE u.age > ? OR (u.age = ? AND id < ?)", sql)
+
+	keys[0].desc = false
+	sql, vals = buildSQL(db.Query("SELECT * FROM users").Where(seekCondition(keys, values, true, true)))
+	assert.Equal(t, "SELECT * FROM users WHERE (u.age, id) < (?, ?)", sql)
+	assert.Equal(t, []interface{}{30, int64(7)}, vals)
+
+	sql, vals = buildSQL(db.Query("SELECT * FROM users").Where("admin", "=", true).Where(seekCondition(keys, values, false, true)))
+	assert.Equal(t, "SELECT * FROM users WHERE admin = ? AND (u.age, id) > (?, ?)", sql)
+	assert.Equal(t, []interface{}{true, 30, int64(7)}, vals)
+
+	// 多次Order的排序列按调用顺序作为游标列
+	tx = db.Query("SELECT * FROM users").Order("u.age DESC").Order("id")
+	keys, err = tx.cursorKeys(sc)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, []string{"u.age", "id"}, []string{keys[0].column, keys[1].column})
+	assert.Equal(t, []bool{true, false}, []bool{keys[0].desc, keys[1].desc})
+	sql, vals = buildSQL(db.Query("SELECT * FROM users").Where(seekCondition(keys, values, false, true)))
+	assert.Equal(t, "SELECT * FROM users WHERE u.age < ? OR (u.age = ? AND id > ?)", sql)
+	assert.Equal(t, []interface{}{30, 30, int64(7)}, vals)
+
+	_, err = decodeCursor("bad!", keys)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = decodeCursor(token[:len(token)-2], keys)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	keys, err = db.Query("SELECT * FROM users").cursorKeys(sc)
+	assert.Nil(t, err)
+	assert.Equal(t, "id", keys[0].column)
+	_, err = db.Query("SELECT * FROM users").Order("missing").cursorKeys(sc)
+	assert.ErrorIs(t, err, ErrCursorKeys)
+}
+
+type cursorOrder struct {
+	ID    int64
+	Order int
+}
+
+func TestCursorConditionStrict(t *testing.T) {
+	db := newTestDB("postgres")
+	db.opts.cacheStore = &sync.Map{}
+	db.opts.namingStrategy = schema.NamingStrategy{}
+	sc, err := schema.Parse(&cursorOrder{}, db.opts.cacheStore, db.opts.namingStrategy)
+	assert.Nil(t, err)
+	keys, err := db.Query("SELECT * FROM orders").Order("order").Order("id").cursorKeys(sc)
+	assert.Nil(t, err)
+	values := []interface{}{3, int64(7)}
+
+	// 保留字列名加引号
+	tx := db.Query("SELECT * FROM orders").Strict().Where(seekCondition(keys, values, false, true))
+	tx.Statement.Schema = sc
+	sql, vals := buildSQL(tx)
+	assert.Nil(t, tx.Error)
+	assert.Equal(t, `SELECT * FROM orders WHERE ("order", "id") > (?, ?)`, sql)
+	assert.Equal(t, values, vals)
+
+	// 非模型列被拒绝
+	keys[0].column = "order); DROP TABLE orders; --"
+	tx = db.Query("SELECT * FROM orders").Strict().Where(seekCondition(keys, values, false, true))
+	tx.Statement.Schema = sc
+	buildSQL(tx)
+	var identErr *IdentifierError
+	assert.True(t, errors.As(tx.Error, &identErr))
+	assert.Equal(t, keys[0].column, identErr.Identifier)
+}
+
+func TestExecAfterFind(t *testing.T) {
+	db, source := newFakeDB(nil)
+	tx := db.Begin()
+	assert.Nil(t, tx.Error)
+	var ids []int64
+	tx.Query("SELECT id FROM users").Where("state", "=", 1).Order("id").Locking(Locking{}).Find(&ids)
+	tx.Exec("select pg_notify(?, ?)", "users", "changed")
+	tx.With("stale", db.Query("SELECT id FROM users").Where("state", "=", 2)).
+		Exec("UPDATE users SET state = ? WHERE id IN (SELECT id FROM stale)", 3)
+	assert.Nil(t, tx.Commit().Error)
+
+	calls := source.Calls()
+	assert.Equal(t, 5, len(calls))
+	assert.Equal(t, "SELECT id FROM users WHERE state = ? ORDER BY id FOR UPDATE", calls[1].SQL)
+	assert.Equal(t, "select pg_notify(?, ?)", calls[2].SQL)
+	assert.Equal(t, []interface{}{"users", "changed"}, calls[2].Args)
+	assert.Equal(t, "WITH stale AS (SELECT id FROM users WHERE state = ?) UPDATE users SET state = ? WHERE id IN (SELECT id FROM stale)", calls[3].SQL)
+	assert.Equal(t, []interface{}{int64(2), int64(3)}, calls[3].Args)
+}
+
+func TestPaginateStrict(t *testing.T) {
+	for _, opts := range []*PaginateOptions{nil, {Parallel: true}, {Window: true}} {
+		db, source := newFakeDB(func(sql string, args []interface{}) fakedb.Result {
+			if strings.HasPrefix(sql, "SELECT COUNT(*)") {
+				return fakedb.Result{Columns: []string{"count"}, Rows: [][]interface{}{{int64(3)}}}
+			}
+			result := fakedb.Result{Columns: []string{"id", "name", "age", "admin"}, Rows: [][]interface{}{{int64(1), "tom", int64(20), false}}}
+			if strings.Contains(sql, "OVER()") {
+				result.Columns = append(result.Columns, windowTotalColumn)
+				result.Rows[0] = append(result.Rows[0], int64(3))
+			}
+			return result
+		})
+		db.opts.strictIdentifiers = true
+		var users []whereUser
+		page, err := db.Query("SELECT * FROM users").Where("age", ">", 18).Order("id DESC").Paginate(1, 2, &users, opts)
+		assert.Nil(t, err, opts)
+		assert.Equal(t, Page{Page: 1, PerPage: 2, Total: 3, Pages: 2, HasNext: true}, page, opts)
+		assert.Equal(t, []whereUser{{ID: 1, Name: "tom", Age: 20}}, users, opts)
+		for _, sql := range source.SQL() {
+			assert.Contains(t, sql, "WHERE `age` > ?", opts)
+		}
+	}
+
+	// 模型中不存在的列仍被拒绝
+	db, _ := newFakeDB(nil)
+	_, err := db.Query("SELECT * FROM users").Strict().Where("password", "=", "x").Paginate(1, 2, &[]whereUser{})
+	var identifierErr *IdentifierError
+	assert.True(t, errors.As(err, &identifierErr))
+}
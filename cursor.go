@@ -0,0 +1,262 @@
+package zsql
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/luoskak/zsql/pkg/schema"
+)
+
+var (
+	// ErrInvalidCursor 游标无法解析或与排序列不符
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrCursorKeys 游标分页需要ORDER BY列或模型主键，且列须在结果中
+	ErrCursorKeys = errors.New("cursor pagination requires order by columns or a primary key")
+)
+
+// CursorOptions After与Before只能设置一个，都为空时为第一页
+type CursorOptions struct {
+	// After 取该游标之后的数据
+	After string
+	// Before 取该游标之前的数据，结果仍按原排序返回
+	Before string
+	// Limit 每页数量
+	Limit int
+	// RowValue 排序方向一致时使用 (a, b) > (?, ?)，否则展开为 a > ? OR (a = ? AND b > ?)
+	RowValue bool
+}
+
+// Cursor 游标分页结果，Next/Prev为下一页/上一页的游标，没有时为空
+type Cursor struct {
+	Next    string `json:"next,omitempty"`
+	Prev    string `json:"prev,omitempty"`
+	HasNext bool   `json:"has_next"`
+	HasPrev bool   `json:"has_prev"`
+}
+
+// CursorPaginate 按游标查询一页数据到dest，dest为结构体切片指针。
+// 排序列取自Order，没有时按模型主键升序，排序列需唯一确定一行且不能为NULL
+func (db *DB) CursorPaginate(dest interface{}, opts CursorOptions) (Cursor, error) {
+	tx := db.getInstance()
+	var result Cursor
+	if opts.Limit < 1 {
+		return result, tx.AddError(ErrInvalidPerPage)
+	}
+	if opts.After != "" && opts.Before != "" {
+		return result, tx.AddError(fmt.Errorf("%w: after and before are both set", ErrInvalidCursor))
+	}
+	if !isStructSlice(dest) {
+		return result, tx.AddError(ErrInvalidValue)
+	}
+	if tx.Error != nil {
+		return result, tx.Error
+	}
+	sc, err := schema.Parse(dest, tx.opts.cacheStore, tx.opts.namingStrategy)
+	if err != nil {
+		return result, tx.AddError(err)
+	}
+	keys, err := tx.cursorKeys(sc)
+	if err != nil {
+		return result, tx.AddError(err)
+	}
+
+	token, before := opts.After, false
+	if opts.Before != "" {
+		token, before = opts.Before, true
+	}
+	if token != "" {
+		values, err := decodeCursor(token, keys)
+		if err != nil {
+			return result, tx.AddError(err)
+		}
+		tx.Where(seekCondition(keys, values, before, opts.RowValue))
+	}
+
+	// 向前翻页时反向排序查询，再将结果倒序
+	columns := make([]OrderByColumn, len(keys))
+	for i, key := range keys {
+		columns[i] = OrderByColumn{Column: key.column, Desc: key.desc != before}
+	}
+	tx.Statement.Clauses["ORDER BY"] = Clause{Name: "ORDER BY", Expression: orderBy{Columns: columns}}
+	tx.Limit(opts.Limit + 1).Find(dest)
+	if tx.Error != nil {
+		return result, tx.Error
+	}
+
+	rv := reflect.ValueOf(dest).Elem()
+	more := rv.Len() > opts.Limit
+	if more {
+		rv.Set(rv.Slice(0, opts.Limit))
+	}
+	if before {
+		swap := reflect.Swapper(rv.Interface())
+		for i, j := 0, rv.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+		result.HasPrev, result.HasNext = more, true
+	} else {
+		result.HasNext, result.HasPrev = more, token != ""
+	}
+	if rv.Len() == 0 {
+		// 越过边界时保留原游标以便返回
+		if before {
+			result.Next = token
+		} else if token != "" {
+			result.Prev = token
+		}
+		return result, nil
+	}
+	if result.HasNext {
+		if result.Next, err = encodeCursor(rv.Index(rv.Len()-1), keys); err != nil {
+			return result, tx.AddError(err)
+		}
+	}
+	if result.HasPrev {
+		if result.Prev, err = encodeCursor(rv.Index(0), keys); err != nil {
+			return result, tx.AddError(err)
+		}
+	}
+	return result, nil
+}
+
+type cursorKey struct {
+	column string
+	desc   bool
+	field  *schema.Field
+}
+
+// cursorKeys 排序列对应到dest的字段，列名可带表名前缀
+func (db *DB) cursorKeys(sc *schema.Schema) ([]cursorKey, error) {
+	var keys []cursorKey
+	if c, ok := db.Statement.Clauses["ORDER BY"]; ok {
+		ob, _ := c.Expression.(orderBy)
+		for _, column := range ob.Columns {
+			if column.Expression != nil || column.Nulls != "" {
+				return nil, fmt.Errorf("%w: expression or NULLS ordering is not supported", ErrCursorKeys)
+			}
+			name := column.Column
+			if i := strings.LastIndexByte(name, '.'); i >= 0 {
+				name = name[i+1:]
+			}
+			field := sc.LookUpField(name)
+			if field == nil || field.DBName == "" {
+				return nil, fmt.Errorf("%w: column %s not found in %s", ErrCursorKeys, column.Column, sc.Name)
+			}
+			keys = append(keys, cursorKey{column: column.Column, desc: column.Desc, field: field})
+		}
+	}
+	if len(keys) == 0 {
+		field := sc.PrimaryField()
+		if field == nil {
+			return nil, ErrCursorKeys
+		}
+		keys = append(keys, cursorKey{column: field.DBName, field: field})
+	}
+	return keys, nil
+}
+
+// seekCondition 游标之后(before时为之前)的条件，
+// 如 a > ? OR (a = ? AND b > ?)，方向一致且rowValue时为 (a, b) > (?, ?)
+func seekCondition(keys []cursorKey, values []interface{}, before, rowValue bool) WhereColumn {
+	greater := func(key cursorKey) bool {
+		return key.desc == before
+	}
+	if rowValue && len(keys) > 1 {
+		same := true
+		for _, key := range keys[1:] {
+			same = same && greater(key) == greater(keys[0])
+		}
+		if same {
+			columns := make([]string, len(keys))
+			for i, key := range keys {
+				columns[i] = key.column
+			}
+			op := " < "
+			if greater(keys[0]) {
+				op = " > "
+			}
+			return &and{Value: rowCompare{columns: columns, op: op, values: values}}
+		}
+	}
+	groups := make([]WhereColumn, len(keys))
+	for i, key := range keys {
+		columns := make([]WhereColumn, 0, i+1)
+		for j := 0; j < i; j++ {
+			columns = append(columns, &and{Field: keys[j].column, Equality: WE_EQ, Value: values[j]})
+		}
+		equality := WE_LT
+		if greater(key) {
+			equality = WE_GT
+		}
+		columns = append(columns, &and{Field: key.column, Equality: equality, Value: values[i]})
+		groups[i] = &or{Columns: columns}
+	}
+	return &and{Columns: groups}
+}
+
+// rowCompare 行值比较 (a, b) > (?, ?)，列名经WriteQuoted输出以便严格模式校验
+type rowCompare struct {
+	columns []string
+	op      string
+	values  []interface{}
+}
+
+func (e rowCompare) Build(builder Builder) {
+	builder.WriteByte('(')
+	for i, column := range e.columns {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.WriteQuoted(column)
+	}
+	builder.WriteString(")" + e.op + "(")
+	for i, column := range e.columns {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.WriteByte('?')
+		builder.AddFieldVar(column, e.values[i])
+	}
+	builder.WriteByte(')')
+}
+
+// encodeCursor 将行的排序列值编码为base64 JSON
+func encodeCursor(row reflect.Value, keys []cursorKey) (string, error) {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i], _ = key.field.ValueOf(row)
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor 按字段类型还原游标中的值
+func decodeCursor(token string, keys []cursorKey) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if len(raws) != len(keys) {
+		return nil, fmt.Errorf("%w: expected %d values, got %d", ErrInvalidCursor, len(keys), len(raws))
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		v := reflect.New(key.field.FieldType)
+		if err := json.Unmarshal(raws[i], v.Interface()); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidCursor, key.column, err)
+		}
+		values[i] = v.Elem().Interface()
+	}
+	return values, nil
+}
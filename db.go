@@ -5,6 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/luoskak/logger"
 	"github.com/luoskak/zsql/pkg/parser"
@@ -12,6 +16,8 @@ import (
 )
 
 type DB struct {
+	name          string
+	dialect       string
 	rConn         ConnPool
 	wConn         ConnPool
 	log           *logger.Logger
@@ -23,6 +29,7 @@ type DB struct {
 	clone         int
 	clausesCaller func(operation string) []string
 	listener      *pgxListener
+	callbacks     *callbacks
 }
 
 func (m *DB) TypeName() string {
@@ -33,6 +40,11 @@ func (m *DB) ID() string {
 	return ""
 }
 
+// Dialect returns the driver name, mysql or postgres
+func (db *DB) Dialect() string {
+	return db.dialect
+}
+
 func (db *DB) getInstance() *DB {
 	if db.clone > 0 {
 		tx := &DB{
@@ -40,9 +52,12 @@ func (db *DB) getInstance() *DB {
 			wConn:         db.wConn,
 			opts:          db.opts,
 			Error:         db.Error,
+			name:          db.name,
+			dialect:       db.dialect,
 			log:           db.log,
 			clausesCaller: db.clausesCaller,
 			listener:      db.listener,
+			callbacks:     db.callbacks,
 		}
 
 		if db.clone == 1 {
@@ -72,6 +87,21 @@ func (db *DB) MustWrite() (tx *DB) {
 	return
 }
 
+// WithContext 之后的语句及Begin开启的事务使用ctx
+func (db *DB) WithContext(ctx context.Context) (tx *DB) {
+	tx = db.getInstance()
+	tx.Statement.Context = ctx
+	return
+}
+
+// contextSession 使用ctx及相同连接(事务中为该事务)的独立实例，
+// 不修改调用方的Statement，也不带入其中的子句
+func (db *DB) contextSession(ctx context.Context) *DB {
+	tx := db.getInstance().session("", nil)
+	tx.Statement.Context = ctx
+	return tx
+}
+
 func (db *DB) Query(sql string, args ...interface{}) (tx *DB) {
 	tx = db.getInstance()
 	tx.Statement.SQL.WriteString(sql)
@@ -93,6 +123,13 @@ func (db *DB) Exec(sql string, args ...interface{}) (tx *DB) {
 	tx = db.getInstance()
 	tx.Statement.SQL.WriteString(sql)
 	tx.Statement.Vals = args
+	// 原生语句只补充WITH，事务中残留的Where等子句不能带入
+	switch parser.Operation(sql) {
+	case "update", "delete":
+		tx.Statement.BuildClauses = []string{"WITH"}
+	default:
+		tx.Statement.BuildClauses = nil
+	}
 	if tx.Statement.ConnPool == nil {
 		tx.Statement.ConnPool = db.wConn
 	}
@@ -113,21 +150,63 @@ func (db *DB) AddNameMap(old, new string) (tx *DB) {
 
 func (db *DB) Where(where ...interface{}) (tx *DB) {
 	tx = db.getInstance()
+	if columns := tx.parseWhere(where...); columns != nil {
+		tx.Statement.AddClause(Where{Columns: columns})
+	}
+	return
+}
+
+// Or 与之前的全部条件以OR连接，参数同Where
+func (db *DB) Or(where ...interface{}) (tx *DB) {
+	tx = db.getInstance()
+	if columns := tx.parseWhere(where...); columns != nil {
+		tx.Statement.AddClause(Where{Columns: []WhereColumn{&or{Columns: columns}}})
+	}
+	return
+}
+
+// Not 条件取反后以AND连接，参数同Where
+func (db *DB) Not(where ...interface{}) (tx *DB) {
+	tx = db.getInstance()
+	if columns := tx.parseWhere(where...); columns != nil {
+		column := columns[0]
+		if len(columns) > 1 {
+			column = &and{Columns: columns}
+		}
+		tx.Statement.AddClause(Where{Columns: []WhereColumn{Not(column)}})
+	}
+	return
+}
+
+// Having 与Where参数相同，需配合GroupBy使用
+func (db *DB) Having(having ...interface{}) (tx *DB) {
+	tx = db.getInstance()
+	if columns := tx.parseWhere(having...); columns != nil {
+		tx.Statement.AddClause(Having{Columns: columns})
+	}
+	return
+}
+
+// parseWhere 解析Where及Having的参数，参数不合法时返回nil
+func (db *DB) parseWhere(where ...interface{}) []WhereColumn {
 	if len(where) == 0 {
-		return
+		return nil
 	}
 	switch v := where[0].(type) {
 	case map[string]interface{}:
 		var travelWhere func(where map[string]interface{}) []WhereColumn
 		travelWhere = func(where map[string]interface{}) []WhereColumn {
 			var columns []WhereColumn
-			for field, v := range where {
+			for _, field := range sortedKeys(where) {
+				v := where[field]
 				vm, ok := v.(map[string]interface{})
 				if !ok {
-					// 不符合要求的
+					// 非操作符map的值视为相等，切片视为IN
+					columns = append(columns, equalColumn(field, v))
 					continue
 				}
-				for op, v := range vm {
+				for _, op := range sortedKeys(vm) {
+					v := vm[op]
 					if op == "OR" || op == "AND" {
 						if sm, is := v.(map[string]interface{}); is {
 							cs := travelWhere(sm)
@@ -139,20 +218,8 @@ func (db *DB) Where(where ...interface{}) (tx *DB) {
 						}
 						continue
 					}
-					if op == "BETWEEN" {
-						if vs, is := v.([]interface{}); is && len(vs) == 2 {
-							columns = append(columns, &and{Field: field, Equality: WE_BETWEEN, Value: vs})
-						}
-						continue
-					}
-					if op == "IN" {
-						if vs, is := v.([]interface{}); is && len(vs) > 0 {
-							columns = append(columns, &and{Field: field, Equality: WE_IN, Value: vs})
-						}
-						continue
-					}
 					quality := ToWhereEquality(op)
-					if quality == "" {
+					if quality == "" || !validWhereValue(quality, v) {
 						continue
 					}
 					columns = append(columns, &and{
@@ -164,116 +231,279 @@ func (db *DB) Where(where ...interface{}) (tx *DB) {
 			}
 			return columns
 		}
-		columns := travelWhere(v)
-		if columns != nil {
-			tx.Statement.AddClause(Where{Columns: columns})
-		}
+		return travelWhere(v)
 	case WhereColumn:
-		tx.Statement.AddClause(Where{Columns: []WhereColumn{v}})
+		return []WhereColumn{v}
+	case Expression:
+		return []WhereColumn{&and{Value: v}}
 	default:
+		if rv := reflect.Indirect(reflect.ValueOf(v)); rv.Kind() == reflect.Struct {
+			return db.structWhere(rv, where[1:]...)
+		}
 		argLen := len(where)
+		if argLen == 2 {
+			// Where("deleted_at", "IS NULL")，操作符为字符串时field须为列名，
+			// 否则如 Where("name = ?", "null") 仍为原生条件
+			if field, ok := where[0].(string); ok {
+				var equality WhereEquality
+				switch op := where[1].(type) {
+				case WhereEquality:
+					equality = op
+				case string:
+					if identifierExp.MatchString(field) {
+						equality = ToWhereEquality(op)
+					}
+				}
+				if equality.noValue() {
+					return []WhereColumn{&and{Field: field, Equality: equality}}
+				}
+			}
+		}
 		if argLen == 3 {
-			if _, ok := where[0].(string); ok {
-				if w1, ok := where[1].(string); ok {
-					equality := ToWhereEquality(w1)
-					if equality == WE_IN || equality == WE_BETWEEN {
-						vs, ok := where[2].([]interface{})
-						if !ok {
-							return
-						}
-						if len(vs) == 0 {
-							return
-						}
-						if len(vs) != 2 && equality == WE_BETWEEN {
-							return
-						}
+			if field, ok := where[0].(string); ok {
+				if equality := toWhereEquality(where[1]); equality != "" {
+					if !validWhereValue(equality, where[2]) {
+						return nil
 					}
-					tx.Statement.AddClause(Where{Columns: []WhereColumn{
+					return []WhereColumn{
 						&and{
-							Field:    where[0].(string),
+							Field:    field,
 							Equality: equality,
 							Value:    where[2],
 						},
-					}})
-					return
-				}
-				if w1, ok := where[1].(WhereEquality); ok {
-					if w1 == WE_IN || w1 == WE_BETWEEN {
-						vs, ok := where[2].([]interface{})
-						if !ok {
-							return
-						}
-						if len(vs) == 0 {
-							return
-						}
-						if len(vs) != 2 && w1 == WE_BETWEEN {
-							return
-						}
 					}
-					tx.Statement.AddClause(Where{Columns: []WhereColumn{
-						&and{
-							Field:    where[0].(string),
-							Equality: w1,
-							Value:    where[2],
-						},
-					}})
-					return
 				}
 			}
 		}
-		if _, ok := where[0].(string); ok {
-			var vs []interface{}
-			for i, v := range where {
-				if i == 0 {
-					continue
-				}
-				vs = append(vs, v)
-			}
-			tx.Statement.AddClause(Where{Columns: []WhereColumn{
+		if semantic, ok := where[0].(string); ok {
+			return []WhereColumn{
 				&and{
-					Semantic: where[0].(string),
-					Value:    vs,
+					Semantic: semantic,
+					Value:    append([]interface{}{}, where[1:]...),
 				},
-			}})
+			}
 		}
 	}
-	return
+	return nil
+}
+
+// structWhere 结构体非零值字段生成相等条件，includes为需要包含的零值字段，
+// 可使用字段名或列名
+func (db *DB) structWhere(rv reflect.Value, includes ...interface{}) []WhereColumn {
+	sc, err := schema.Parse(rv.Interface(), db.opts.cacheStore, db.opts.namingStrategy)
+	if err != nil {
+		db.AddError(err)
+		return nil
+	}
+	included := make(map[string]bool, len(includes))
+	for _, include := range includes {
+		if name, ok := include.(string); ok {
+			included[name] = true
+		}
+	}
+	var columns []WhereColumn
+	for _, field := range sc.Fields {
+		if field.DBName == "" {
+			continue
+		}
+		value, zero := field.ValueOf(rv)
+		if zero && !included[field.Name] && !included[field.DBName] {
+			continue
+		}
+		columns = append(columns, &and{Field: field.DBName, Equality: WE_EQ, Value: value})
+	}
+	return columns
+}
+
+// equalColumn 切片生成IN，空切片生成恒假条件，其他生成相等条件
+func equalColumn(field string, value interface{}) WhereColumn {
+	if _, ok := value.(*DB); ok {
+		return &and{Field: field, Equality: WE_IN, Value: value}
+	}
+	if _, ok := value.([]byte); !ok && value != nil {
+		if rv := reflect.ValueOf(value); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			if rv.Len() == 0 {
+				return &and{Semantic: "1 = 0", Value: []interface{}{}}
+			}
+			vs := make([]interface{}, rv.Len())
+			for i := range vs {
+				vs[i] = rv.Index(i).Interface()
+			}
+			return &and{Field: field, Equality: WE_IN, Value: vs}
+		}
+	}
+	return &and{Field: field, Equality: WE_EQ, Value: value}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validWhereValue IN需要非空切片、子查询或Expression，BETWEEN需要两个值或Expression
+func validWhereValue(equality WhereEquality, value interface{}) bool {
+	if !equality.multiValue() {
+		return true
+	}
+	if _, ok := value.(Expression); ok {
+		return true
+	}
+	if _, ok := value.(*DB); ok {
+		return equality == WE_IN || equality == WE_NIN
+	}
+	vs, ok := value.([]interface{})
+	if !ok || len(vs) == 0 {
+		return false
+	}
+	return (equality != WE_BETWEEN && equality != WE_NBETWEEN) || len(vs) == 2
 }
 
+func toWhereEquality(v interface{}) WhereEquality {
+	switch w := v.(type) {
+	case string:
+		return ToWhereEquality(w)
+	case WhereEquality:
+		return w
+	}
+	return ""
+}
+
+// orderExp 解析 "name DESC NULLS LAST" 形式的排序
+var orderExp = regexp.MustCompile(`(?i)^\s*(\S+)(?:\s+(ASC|DESC))?(?:\s+NULLS\s+(FIRST|LAST))?\s*$`)
+
+// Order value为列名(可带ASC/DESC及NULLS FIRST/LAST)、OrderByColumn、Expr，
+// 或[][]string{{列名, "ASC"|"DESC", 可选的"NULLS FIRST"|"NULLS LAST"}}
 func (db *DB) Order(value interface{}) (tx *DB) {
 	tx = db.getInstance()
 
 	switch v := value.(type) {
-	case orderByColumn:
+	case OrderByColumn:
 		tx.Statement.AddClause(orderBy{
-			Columns: []orderByColumn{v},
+			Columns: []OrderByColumn{v},
+		})
+	case Expression:
+		tx.Statement.AddClause(orderBy{
+			Columns: []OrderByColumn{{Expression: v}},
 		})
 	case string:
 		if v != "" {
+			column := OrderByColumn{Column: v}
+			if m := orderExp.FindStringSubmatch(v); m != nil {
+				column = OrderByColumn{
+					Column: m[1],
+					Desc:   strings.EqualFold(m[2], "DESC"),
+					Nulls:  strings.ToUpper(m[3]),
+				}
+			}
 			tx.Statement.AddClause(orderBy{
-				Columns: []orderByColumn{
-					{Column: v},
-				},
+				Columns: []OrderByColumn{column},
 			})
 		}
 	case [][]string:
 		if len(v) == 0 {
 			return
 		}
-		var columns []orderByColumn
+		var columns []OrderByColumn
 		for _, i := range v {
+			if len(i) < 2 {
+				continue
+			}
+			column := OrderByColumn{Column: i[0]}
 			switch i[1] {
 			case "ASC":
-				columns = append(columns, orderByColumn{Column: i[0]})
 			case "DESC":
-				columns = append(columns, orderByColumn{Column: i[0], Desc: true})
+				column.Desc = true
+			default:
+				continue
+			}
+			if len(i) > 2 {
+				switch strings.TrimPrefix(strings.ToUpper(i[2]), "NULLS ") {
+				case NullsFirst:
+					column.Nulls = NullsFirst
+				case NullsLast:
+					column.Nulls = NullsLast
+				}
 			}
+			columns = append(columns, column)
 		}
 		tx.Statement.AddClause(orderBy{Columns: columns})
 	}
 	return
 }
 
+// With 添加公用表表达式，name可带列名如 "tree(id, parent_id)"
+func (db *DB) With(name string, subQuery *DB) (tx *DB) {
+	tx = db.getInstance()
+	tx.Statement.AddClause(with{CTEs: []cte{{Name: name, SubQuery: subQuery}}})
+	return
+}
+
+// WithRecursive 同With，生成 WITH RECURSIVE
+func (db *DB) WithRecursive(name string, subQuery *DB) (tx *DB) {
+	tx = db.getInstance()
+	tx.Statement.AddClause(with{Recursive: true, CTEs: []cte{{Name: name, SubQuery: subQuery}}})
+	return
+}
+
+// Union 合并多个查询，之后的Order及Limit作用于整个结果
+func (db *DB) Union(queries ...*DB) (tx *DB) {
+	return db.setOperation("UNION", queries)
+}
+
+func (db *DB) UnionAll(queries ...*DB) (tx *DB) {
+	return db.setOperation("UNION ALL", queries)
+}
+
+// Intersect mysql需8.0.31及以上
+func (db *DB) Intersect(queries ...*DB) (tx *DB) {
+	return db.setOperation("INTERSECT", queries)
+}
+
+// Except mysql需8.0.31及以上
+func (db *DB) Except(queries ...*DB) (tx *DB) {
+	return db.setOperation("EXCEPT", queries)
+}
+
+// setOperation 每个查询加括号后以op连接，参数按查询顺序合并
+func (db *DB) setOperation(op string, queries []*DB) (tx *DB) {
+	tx = db.getInstance()
+	for idx, query := range queries {
+		if query.Error != nil {
+			tx.AddError(query.Error)
+		}
+		if idx > 0 {
+			tx.Statement.WriteString(" " + op + " ")
+		}
+		tx.Statement.WriteByte('(')
+		buildSubQuery(tx.Statement, query)
+		tx.Statement.WriteByte(')')
+	}
+	tx.Statement.BuildClauses = tx.clausesCaller("UNION")
+	if tx.Statement.ConnPool == nil {
+		tx.Statement.ConnPool = db.rConn
+	}
+	return
+}
+
+// Joins 添加表连接，value为原生语句如 "LEFT JOIN orders o ON o.user_id = users.id"
+// 及其参数，或者Join
+func (db *DB) Joins(value interface{}, args ...interface{}) (tx *DB) {
+	tx = db.getInstance()
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			tx.Statement.AddClause(joins{Joins: []Join{{Expression: v, Vars: args}}})
+		}
+	case Join:
+		tx.Statement.AddClause(joins{Joins: []Join{v}})
+	}
+	return
+}
+
 func (db *DB) GroupBy(column string) (tx *DB) {
 	tx = db.getInstance()
 	tx.Statement.AddClause(groupBy{Columns: []groupByColumn{{Column: column}}})
@@ -301,6 +531,20 @@ func (db *DB) Paging(page, perPage int) (tx *DB) {
 	return
 }
 
+// Locking 为查询加行锁，必须在Begin返回的事务中调用
+func (db *DB) Locking(locking Locking) (tx *DB) {
+	tx = db.getInstance()
+	if _, ok := tx.Statement.ConnPool.(TxCommitter); !ok {
+		tx.AddError(ErrLockingOutsideTransaction)
+		return
+	}
+	if locking.Strength == "" {
+		locking.Strength = LockingStrengthUpdate
+	}
+	tx.Statement.AddClause(locking)
+	return
+}
+
 func (db *DB) Find(dest interface{}) (tx *DB) {
 	tx = db.getInstance()
 	tx.Statement.Dest = dest
@@ -317,6 +561,29 @@ func (db *DB) AddError(err error) error {
 }
 
 func executeQuery(db *DB) *DB {
+	db.callbacks.Query().Execute(db)
+	db.Statement.resetSQL()
+	return db
+}
+
+func executeExec(db *DB) *DB {
+	cs := db.callbacks
+	switch parser.Operation(db.Statement.SQL.String()) {
+	case "insert":
+		cs.Create().Execute(db)
+	case "update":
+		cs.Update().Execute(db)
+	case "delete":
+		cs.Delete().Execute(db)
+	default:
+		cs.Exec().Execute(db)
+	}
+	db.Statement.resetSQL()
+	return db
+}
+
+// query 内置查询回调
+func query(db *DB) {
 	st := db.Statement
 
 	if st.Model == nil {
@@ -351,41 +618,46 @@ func executeQuery(db *DB) *DB {
 
 	if db.Error == nil {
 		st.Build(st.BuildClauses...)
+		if db.Error != nil {
+			return
+		}
 		sql := st.SQL.String()
-		db.log.Info(parser.ExplainSQL(sql, nil, "'", st.Vals...))
-		rows, err := st.ConnPool.QueryContext(st.Context, sql, st.Vals...)
+		ctx, span := db.startSpan(sql)
+		begin := time.Now()
+		rows, err := st.ConnPool.QueryContext(ctx, db.withSQLComment(ctx, sql, span), st.Vals...)
 		if err != nil {
 			db.AddError(err)
-			return db
+			db.finish(span, sql, begin)
+			return
 		}
 		defer rows.Close()
 
 		Scan(rows, db)
+		db.finish(span, sql, begin)
 	}
-
-	st.SQL.Reset()
-	st.Vals = nil
-
-	return db
 }
 
-func executeExec(db *DB) *DB {
+// exec 内置执行回调，create、update、delete共用
+func exec(db *DB) {
 	st := db.Statement
 	if db.Error == nil {
 		st.Build(st.BuildClauses...)
+		if db.Error != nil {
+			return
+		}
 		sql := st.SQL.String()
-		db.log.Info(parser.ExplainSQL(sql, nil, "'", st.Vals...))
-		result, err := st.ConnPool.ExecContext(st.Context, sql, st.Vals...)
-		if err != nil {
-			db.AddError(err)
-			return db
+		ctx, span := db.startSpan(sql)
+		begin := time.Now()
+		result, err := st.ConnPool.ExecContext(ctx, db.withSQLComment(ctx, sql, span), st.Vals...)
+		if err == nil {
+			st.RowsAffected, err = result.RowsAffected()
 		}
-		affected, err := result.RowsAffected()
 		if err != nil {
 			db.AddError(err)
-			return db
+			db.finish(span, sql, begin)
+			return
 		}
-		st.RowsAffected = affected
+		db.finish(span, sql, begin)
 		// postgres driver not support this
 		// last, err := result.LastInsertId()
 		// if err != nil {
@@ -394,8 +666,20 @@ func executeExec(db *DB) *DB {
 		// }
 		// st.LastInsertId = last
 	}
-	st.SQL.Reset()
-	st.Vals = nil
+}
+
+// finish 语句执行完毕后记录日志、上报耗时并结束span
+func (db *DB) finish(span Span, sql string, begin time.Time) {
+	elapsed := time.Since(begin)
+	db.trace(sql, elapsed)
+	if db.opts.metrics != nil {
+		db.opts.metrics.ObserveQuery(db.name, parser.Operation(sql), elapsed, db.Error)
+	}
+	endSpan(span, db.Error)
+}
 
-	return db
+func (db *DB) observeTransaction(outcome string) {
+	if db.opts.metrics != nil {
+		db.opts.metrics.ObserveTransaction(db.name, outcome)
+	}
 }
@@ -0,0 +1,38 @@
+package zsql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Rebind 将?占位符按方言转换，postgres为$1、$2...，
+// 引号内的?保持不变
+func (db *DB) Rebind(query string) string {
+	if db.dialect != "postgres" || strings.IndexByte(query, '?') < 0 {
+		return query
+	}
+	var (
+		b     strings.Builder
+		n     int
+		quote byte
+	)
+	b.Grow(len(query) + 8)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -6,4 +6,6 @@ var (
 	ErrInvalidValue = errors.New("invalid value, should be pointer to struct or slice")
 	// ErrInvalidTransaction invalid transaction when you are trying to `Commit` or `Rollback`
 	ErrInvalidTransaction = errors.New("invalid transaction")
+	// ErrLockingOutsideTransaction 行锁在事务结束时释放，事务外使用没有意义
+	ErrLockingOutsideTransaction = errors.New("locking clause must be used in a transaction")
 )
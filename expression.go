@@ -1,6 +1,25 @@
 package zsql
 
-// Expression expression interface
+// Expression expression interface，实现该接口的值均可作为Where、Order的条件或值
 type Expression interface {
 	Build(builder Builder)
 }
+
+type expr struct {
+	SQL  string
+	Vars []interface{}
+}
+
+// Expr 原样输出的SQL片段，args按顺序绑定到其中的?，可作为Where及Order的值，
+// 作为IN的值时加括号，如
+//
+//	db.Where("updated_at", ">", zsql.Expr("NOW() - INTERVAL ? DAY", 1))
+//	db.Where("id", "IN", zsql.Expr("SELECT user_id FROM orders"))
+func Expr(sql string, args ...interface{}) Expression {
+	return expr{SQL: sql, Vars: args}
+}
+
+func (e expr) Build(builder Builder) {
+	builder.WriteString(e.SQL)
+	builder.AddVar(e.Vars...)
+}
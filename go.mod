@@ -3,10 +3,12 @@ module github.com/luoskak/zsql
 go 1.16
 
 require (
-	github.com/jackc/pgx/v4 v4.14.1 // indirect
-	github.com/luoskak/logger v0.0.1 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
-	github.com/luoskak/logger v0.0.1 // indirect
-	github.com/luoskak/mist v1.0.0 // indirect
-	github.com/luoskak/plant v0.1.0 // indirect
+	github.com/jackc/pgconn v1.10.1
+	github.com/jackc/pgx/v4 v4.14.1
+	github.com/luoskak/logger v0.0.1
+	github.com/luoskak/mist v1.0.0
+	github.com/luoskak/plant v0.1.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
 )
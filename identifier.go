@@ -0,0 +1,94 @@
+package zsql
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidIdentifier 严格模式下列名未通过校验
+var ErrInvalidIdentifier = errors.New("invalid identifier")
+
+// IdentifierError 严格模式下被拒绝的列名
+type IdentifierError struct {
+	Identifier string
+}
+
+func (e *IdentifierError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrInvalidIdentifier, e.Identifier)
+}
+
+func (e *IdentifierError) Unwrap() error {
+	return ErrInvalidIdentifier
+}
+
+var identifierExp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// tableName 表名，WriteQuoted时不做列名校验
+type tableName string
+
+// QuoteIdentifier 按数据库类型为标识符加引号，table.column分别加引号
+func QuoteIdentifier(dialect, name string) string {
+	quote := `"`
+	if dialect == "mysql" {
+		quote = "`"
+	}
+	parts := strings.Split(name, ".")
+	for idx, part := range parts {
+		parts[idx] = quote + strings.ReplaceAll(part, quote, quote+quote) + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// Strict 本次查询启用严格模式，ORDER BY、GROUP BY及条件中的列名须为模型的列、
+// NameMapper中的名称或allow中的值，allow中的表达式原样输出
+func (db *DB) Strict(allow ...string) (tx *DB) {
+	tx = db.getInstance()
+	tx.Statement.strict = true
+	if tx.Statement.allowColumns == nil {
+		tx.Statement.allowColumns = make(map[string]struct{}, len(allow))
+	}
+	for _, column := range allow {
+		tx.Statement.allowColumns[column] = struct{}{}
+	}
+	return
+}
+
+func (st *Statement) strictIdentifiers() bool {
+	return st.strict || (st.DB != nil && st.DB.opts != nil && st.DB.opts.strictIdentifiers)
+}
+
+// writeIdentifier 校验通过的列名加引号输出，否则记录IdentifierError
+func (st *Statement) writeIdentifier(name string) {
+	if _, ok := st.allowColumns[name]; ok && !identifierExp.MatchString(name) {
+		st.WriteString(name)
+		return
+	}
+	if !st.allowedIdentifier(name) {
+		st.AddError(&IdentifierError{Identifier: name})
+		return
+	}
+	st.WriteString(QuoteIdentifier(st.dialect, name))
+}
+
+func (st *Statement) allowedIdentifier(name string) bool {
+	if !identifierExp.MatchString(name) {
+		return false
+	}
+	if _, ok := st.allowColumns[name]; ok {
+		return true
+	}
+	if st.Schema == nil {
+		return false
+	}
+	table, column := "", name
+	if idx := strings.IndexByte(name, '.'); idx >= 0 {
+		table, column = name[:idx], name[idx+1:]
+	}
+	if table != "" && table != st.Schema.Table && table != st.Table {
+		return false
+	}
+	_, ok := st.Schema.FieldsByDBName[column]
+	return ok
+}
@@ -0,0 +1,199 @@
+// Package fakedb 测试用的database/sql驱动，以mysql为名注册，
+// 记录收到的语句，查询结果由Handler决定
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DriverName 与zsql.MysqlAddress使用的驱动名一致
+const DriverName = "mysql"
+
+// 事务语句以这些名称记录
+const (
+	Begin    = "BEGIN"
+	Commit   = "COMMIT"
+	Rollback = "ROLLBACK"
+)
+
+var ErrPrepare = errors.New("fakedb: prepare is not supported")
+
+// Call 一次执行，Args为驱动转换后的值
+type Call struct {
+	SQL  string
+	Args []interface{}
+}
+
+// Result 查询时返回Columns及Rows，执行时返回RowsAffected，Err不为空时返回错误
+type Result struct {
+	Columns      []string
+	Rows         [][]interface{}
+	RowsAffected int64
+	Err          error
+}
+
+// Handler 根据语句返回结果，在记录语句之后调用
+type Handler func(sql string, args []interface{}) Result
+
+// Source 一个数据源，通过DSN打开
+type Source struct {
+	dsn     string
+	handler Handler
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var (
+	mu      sync.Mutex
+	sources = map[string]*Source{}
+)
+
+func init() {
+	sql.Register(DriverName, fakeDriver{})
+}
+
+// New 注册新的数据源，handler为nil时查询返回空结果
+func New(handler Handler) *Source {
+	mu.Lock()
+	defer mu.Unlock()
+	s := &Source{dsn: fmt.Sprintf("fakedb-%d", len(sources)+1), handler: handler}
+	sources[s.dsn] = s
+	return s
+}
+
+// DSN 可附加?或&开头的参数
+func (s *Source) DSN() string {
+	return s.dsn
+}
+
+// Open 打开该数据源的*sql.DB
+func (s *Source) Open() *sql.DB {
+	db, _ := sql.Open(DriverName, s.dsn)
+	return db
+}
+
+// Calls 至今为止的全部执行，按执行顺序
+func (s *Source) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// SQL 同Calls，只返回语句
+func (s *Source) SQL() []string {
+	calls := s.Calls()
+	sqls := make([]string, len(calls))
+	for i, call := range calls {
+		sqls[i] = call.SQL
+	}
+	return sqls
+}
+
+func (s *Source) call(query string, args []driver.NamedValue) Result {
+	vs := make([]interface{}, len(args))
+	for i, arg := range args {
+		vs[i] = arg.Value
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{SQL: query, Args: vs})
+	s.mu.Unlock()
+	if s.handler == nil {
+		return Result{}
+	}
+	return s.handler(query, vs)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	if i := strings.IndexAny(dsn, "?&"); i >= 0 {
+		dsn = dsn[:i]
+	}
+	mu.Lock()
+	s, ok := sources[dsn]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fakedb: unknown dsn %s", dsn)
+	}
+	return &conn{source: s}, nil
+}
+
+type conn struct {
+	source *Source
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return nil, ErrPrepare
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if r := c.source.call(Begin, nil); r.Err != nil {
+		return nil, r.Err
+	}
+	return &tx{source: c.source}, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r := c.source.call(query, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return &rows{columns: r.Columns, rows: r.Rows}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r := c.source.call(query, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return driver.RowsAffected(r.RowsAffected), nil
+}
+
+type tx struct {
+	source *Source
+}
+
+func (t *tx) Commit() error {
+	return t.source.call(Commit, nil).Err
+}
+
+func (t *tx) Rollback() error {
+	return t.source.call(Rollback, nil).Err
+}
+
+type rows struct {
+	columns []string
+	rows    [][]interface{}
+	idx     int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.idx >= len(r.rows) {
+		return io.EOF
+	}
+	for i := range dest {
+		dest[i] = r.rows[r.idx][i]
+	}
+	r.idx++
+	return nil
+}
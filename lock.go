@@ -0,0 +1,209 @@
+package zsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	lockRetryInterval = 100 * time.Millisecond
+	// mysqlLockNameLen GET_LOCK名称上限
+	mysqlLockNameLen = 64
+)
+
+var (
+	// ErrLockNotAcquired 锁被其他会话持有，TryOnly或Timeout到期时返回
+	ErrLockNotAcquired = errors.New("lock not acquired")
+	// ErrLockNotHeld 释放时发现锁已不属于当前会话
+	ErrLockNotHeld = errors.New("lock not held")
+	// ErrLockNotSupported 当前数据库不支持该类型的锁，如MySQL的事务锁
+	ErrLockNotSupported = errors.New("lock not supported by dialect")
+)
+
+// LockOptions 为nil时一直等待直到获得锁或ctx结束
+type LockOptions struct {
+	// Timeout 等待锁的最长时间，0表示一直等待
+	Timeout time.Duration
+	// TryOnly 只尝试一次，锁被占用立即返回ErrLockNotAcquired
+	TryOnly bool
+}
+
+// Lock 命名锁，会话锁独占一个连接直到Release或ctx结束
+type Lock struct {
+	key     string
+	db      *DB
+	conn    *sql.Conn
+	xact    bool
+	once    sync.Once
+	done    chan struct{}
+	release error
+}
+
+type connPinner interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+// Lock 获取命名锁，postgres使用advisory lock，mysql使用GET_LOCK。
+// 在事务中调用时为事务锁(仅postgres)，随事务提交或回滚释放；
+// 否则为会话锁，ctx结束时自动释放
+func (db *DB) Lock(ctx context.Context, key string, opts ...*LockOptions) (*Lock, error) {
+	tx := db.getInstance()
+	var opt LockOptions
+	if len(opts) > 0 && opts[0] != nil {
+		opt = *opts[0]
+	}
+	l := &Lock{key: key, db: tx, done: make(chan struct{})}
+
+	var conn ConnPool
+	if _, ok := tx.Statement.ConnPool.(TxCommitter); ok {
+		if tx.dialect != "postgres" {
+			return nil, ErrLockNotSupported
+		}
+		l.xact = true
+		conn = tx.Statement.ConnPool
+	} else {
+		pinner, ok := tx.wConn.(connPinner)
+		if !ok {
+			return nil, ErrLockNotSupported
+		}
+		c, err := pinner.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = c
+		conn = c
+	}
+
+	if err := l.acquire(ctx, conn, opt); err != nil {
+		if l.conn != nil {
+			l.conn.Close()
+		}
+		return nil, err
+	}
+	if !l.xact {
+		go func() {
+			select {
+			case <-ctx.Done():
+				if err := l.Release(); err != nil {
+					tx.log.Error("release lock %s: %v", key, err)
+				}
+			case <-l.done:
+			}
+		}()
+	}
+	return l, nil
+}
+
+// Key 锁名
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Release 释放会话锁并归还连接，可重复调用；事务锁无需释放
+func (l *Lock) Release() error {
+	if l.xact {
+		return nil
+	}
+	l.once.Do(func() {
+		defer close(l.done)
+		defer l.conn.Close()
+		var (
+			released sql.NullInt64
+			err      error
+		)
+		// ctx可能已结束，释放使用独立的context
+		if l.db.dialect == "postgres" {
+			var ok bool
+			err = l.conn.QueryRowContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID(l.key)).Scan(&ok)
+			if ok {
+				released.Int64 = 1
+			}
+		} else {
+			err = l.conn.QueryRowContext(context.Background(), "SELECT RELEASE_LOCK(?)", mysqlLockName(l.key)).Scan(&released)
+		}
+		if err == nil && released.Int64 != 1 {
+			err = fmt.Errorf("%w: %s", ErrLockNotHeld, l.key)
+		}
+		l.release = err
+	})
+	return l.release
+}
+
+func (l *Lock) acquire(ctx context.Context, conn ConnPool, opt LockOptions) error {
+	if l.db.dialect != "postgres" {
+		return l.acquireMySQL(ctx, conn, opt)
+	}
+	id := lockID(l.key)
+	lockFn, tryFn := "pg_advisory_lock", "pg_try_advisory_lock"
+	if l.xact {
+		lockFn, tryFn = "pg_advisory_xact_lock", "pg_try_advisory_xact_lock"
+	}
+	if !opt.TryOnly && opt.Timeout <= 0 {
+		_, err := conn.ExecContext(ctx, "SELECT "+lockFn+"($1)", id)
+		return err
+	}
+	// 超时通过轮询实现，避免取消查询导致连接或事务失效
+	var deadline time.Time
+	if opt.Timeout > 0 {
+		deadline = time.Now().Add(opt.Timeout)
+	}
+	for {
+		var ok bool
+		if err := conn.QueryRowContext(ctx, "SELECT "+tryFn+"($1)", id).Scan(&ok); err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		wait := lockRetryInterval
+		if opt.TryOnly || !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %s", ErrLockNotAcquired, l.key)
+		}
+		if remain := time.Until(deadline); remain < wait {
+			wait = remain
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (l *Lock) acquireMySQL(ctx context.Context, conn ConnPool, opt LockOptions) error {
+	// GET_LOCK超时单位为秒，负数表示一直等待
+	timeout := -1.0
+	if opt.TryOnly {
+		timeout = 0
+	} else if opt.Timeout > 0 {
+		timeout = math.Ceil(opt.Timeout.Seconds())
+	}
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", mysqlLockName(l.key), timeout).Scan(&acquired); err != nil {
+		return err
+	}
+	if acquired.Int64 != 1 {
+		return fmt.Errorf("%w: %s", ErrLockNotAcquired, l.key)
+	}
+	return nil
+}
+
+// lockID advisory lock使用int64键，字符串键取fnv-1a哈希
+func lockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+func mysqlLockName(key string) string {
+	if len(key) <= mysqlLockNameLen {
+		return key
+	}
+	return fmt.Sprintf("zsql:%x", uint64(lockID(key)))
+}
@@ -0,0 +1,245 @@
+package zsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockHandler 按语句返回单列结果，values为各函数的返回值
+func lockHandler(values map[string]interface{}) fakedb.Handler {
+	var mu sync.Mutex
+	return func(sql string, args []interface{}) fakedb.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		for fn, v := range values {
+			if strings.Contains(sql, fn+"(") {
+				if err, ok := v.(error); ok {
+					return fakedb.Result{Err: err}
+				}
+				return fakedb.Result{Columns: []string{"v"}, Rows: [][]interface{}{{v}}}
+			}
+		}
+		return fakedb.Result{}
+	}
+}
+
+func newLockDB(dialect string, values map[string]interface{}) (*DB, *fakedb.Source) {
+	db, source := newFakeDB(lockHandler(values))
+	db.dialect = dialect
+	return db, source
+}
+
+func TestLockSQL(t *testing.T) {
+	id := lockID("jobs")
+	long := strings.Repeat("k", 65)
+	cases := []struct {
+		name    string
+		dialect string
+		key     string
+		tx      bool
+		opts    *LockOptions
+		want    []fakedb.Call
+	}{
+		{
+			name:    "postgres session",
+			dialect: "postgres",
+			key:     "jobs",
+			want: []fakedb.Call{
+				{SQL: "SELECT pg_advisory_lock($1)", Args: []interface{}{id}},
+				{SQL: "SELECT pg_advisory_unlock($1)", Args: []interface{}{id}},
+			},
+		},
+		{
+			name:    "postgres try",
+			dialect: "postgres",
+			key:     "jobs",
+			opts:    &LockOptions{TryOnly: true},
+			want: []fakedb.Call{
+				{SQL: "SELECT pg_try_advisory_lock($1)", Args: []interface{}{id}},
+				{SQL: "SELECT pg_advisory_unlock($1)", Args: []interface{}{id}},
+			},
+		},
+		{
+			name:    "postgres xact",
+			dialect: "postgres",
+			key:     "jobs",
+			tx:      true,
+			want: []fakedb.Call{
+				{SQL: fakedb.Begin, Args: []interface{}{}},
+				{SQL: "SELECT pg_advisory_xact_lock($1)", Args: []interface{}{id}},
+				{SQL: fakedb.Commit, Args: []interface{}{}},
+			},
+		},
+		{
+			name:    "postgres xact try",
+			dialect: "postgres",
+			key:     "jobs",
+			tx:      true,
+			opts:    &LockOptions{Timeout: time.Second},
+			want: []fakedb.Call{
+				{SQL: fakedb.Begin, Args: []interface{}{}},
+				{SQL: "SELECT pg_try_advisory_xact_lock($1)", Args: []interface{}{id}},
+				{SQL: fakedb.Commit, Args: []interface{}{}},
+			},
+		},
+		{
+			name:    "mysql wait",
+			dialect: "mysql",
+			key:     "jobs",
+			want: []fakedb.Call{
+				{SQL: "SELECT GET_LOCK(?, ?)", Args: []interface{}{"jobs", float64(-1)}},
+				{SQL: "SELECT RELEASE_LOCK(?)", Args: []interface{}{"jobs"}},
+			},
+		},
+		{
+			name:    "mysql timeout",
+			dialect: "mysql",
+			key:     long,
+			opts:    &LockOptions{Timeout: 1500 * time.Millisecond},
+			want: []fakedb.Call{
+				{SQL: "SELECT GET_LOCK(?, ?)", Args: []interface{}{mysqlLockName(long), float64(2)}},
+				{SQL: "SELECT RELEASE_LOCK(?)", Args: []interface{}{mysqlLockName(long)}},
+			},
+		},
+		{
+			name:    "mysql try",
+			dialect: "mysql",
+			key:     "jobs",
+			opts:    &LockOptions{TryOnly: true},
+			want: []fakedb.Call{
+				{SQL: "SELECT GET_LOCK(?, ?)", Args: []interface{}{"jobs", float64(0)}},
+				{SQL: "SELECT RELEASE_LOCK(?)", Args: []interface{}{"jobs"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		db, source := newLockDB(c.dialect, map[string]interface{}{
+			"pg_try_advisory_lock": true, "pg_try_advisory_xact_lock": true, "pg_advisory_unlock": true,
+			"GET_LOCK": int64(1), "RELEASE_LOCK": int64(1),
+		})
+		if c.tx {
+			err := db.Transaction(context.Background(), func(tx *DB) error {
+				l, err := tx.Lock(context.Background(), c.key, c.opts)
+				if err != nil {
+					return err
+				}
+				return l.Release()
+			})
+			assert.Nil(t, err, c.name)
+		} else {
+			l, err := db.Lock(context.Background(), c.key, c.opts)
+			if assert.Nil(t, err, c.name) {
+				assert.Equal(t, c.key, l.Key())
+				assert.Nil(t, l.Release(), c.name)
+				// 可重复释放
+				assert.Nil(t, l.Release(), c.name)
+			}
+		}
+		assert.Equal(t, c.want, source.Calls(), c.name)
+	}
+	assert.True(t, len(mysqlLockName(long)) <= mysqlLockNameLen)
+	assert.True(t, strings.HasPrefix(mysqlLockName(long), "zsql:"))
+}
+
+func TestLockMySQLTransaction(t *testing.T) {
+	db, source := newLockDB("mysql", nil)
+	err := db.Transaction(context.Background(), func(tx *DB) error {
+		_, err := tx.Lock(context.Background(), "jobs")
+		return err
+	})
+	assert.True(t, errors.Is(err, ErrLockNotSupported))
+	assert.Equal(t, []string{fakedb.Begin, fakedb.Rollback}, source.SQL())
+}
+
+func TestLockNotAcquired(t *testing.T) {
+	db, source := newLockDB("postgres", map[string]interface{}{"pg_try_advisory_lock": false})
+	_, err := db.Lock(context.Background(), "jobs", &LockOptions{TryOnly: true})
+	assert.True(t, errors.Is(err, ErrLockNotAcquired))
+	assert.Equal(t, 1, len(source.Calls()))
+
+	db, _ = newLockDB("mysql", map[string]interface{}{"GET_LOCK": int64(0)})
+	_, err = db.Lock(context.Background(), "jobs", &LockOptions{Timeout: time.Second})
+	assert.True(t, errors.Is(err, ErrLockNotAcquired))
+
+	// 连接已归还
+	assert.Equal(t, 0, db.wConn.(*sql.DB).Stats().InUse)
+}
+
+func TestLockTimeout(t *testing.T) {
+	db, source := newLockDB("postgres", map[string]interface{}{"pg_try_advisory_lock": false})
+	begin := time.Now()
+	_, err := db.Lock(context.Background(), "jobs", &LockOptions{Timeout: 250 * time.Millisecond})
+	elapsed := time.Since(begin)
+	assert.True(t, errors.Is(err, ErrLockNotAcquired))
+	assert.True(t, elapsed >= 250*time.Millisecond, elapsed)
+	assert.True(t, elapsed < time.Second, elapsed)
+	// 每100ms重试一次，到期时再尝试一次
+	calls := len(source.Calls())
+	assert.True(t, calls >= 3 && calls <= 4, calls)
+
+	// ctx先于Timeout结束
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = db.Lock(ctx, "jobs", &LockOptions{Timeout: time.Second})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, db.wConn.(*sql.DB).Stats().InUse)
+}
+
+func TestLockReleaseOnCancel(t *testing.T) {
+	db, source := newLockDB("mysql", map[string]interface{}{"GET_LOCK": int64(1), "RELEASE_LOCK": int64(1)})
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := db.Lock(ctx, "jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.wConn.(*sql.DB).Stats().InUse)
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		return len(source.Calls()) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "SELECT RELEASE_LOCK(?)", source.Calls()[1].SQL)
+	assert.Eventually(t, func() bool {
+		return db.wConn.(*sql.DB).Stats().InUse == 0
+	}, time.Second, time.Millisecond)
+	// 已自动释放，再次释放不会执行语句
+	assert.Nil(t, l.Release())
+	assert.Equal(t, 2, len(source.Calls()))
+}
+
+func TestLockReleaseNotHeld(t *testing.T) {
+	db, _ := newLockDB("mysql", map[string]interface{}{"GET_LOCK": int64(1), "RELEASE_LOCK": int64(0)})
+	l, err := db.Lock(context.Background(), "jobs")
+	assert.Nil(t, err)
+	err = l.Release()
+	assert.True(t, errors.Is(err, ErrLockNotHeld))
+	assert.Equal(t, err, l.Release())
+}
+
+func TestLockReleaseStopsWatcher(t *testing.T) {
+	db, _ := newLockDB("postgres", map[string]interface{}{"pg_advisory_unlock": true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 预热连接池，避免其goroutine计入
+	l, err := db.Lock(ctx, "warmup")
+	assert.Nil(t, err)
+	assert.Nil(t, l.Release())
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		l, err := db.Lock(ctx, "jobs")
+		assert.Nil(t, err)
+		assert.Nil(t, l.Release())
+	}
+	// ctx未结束，释放后等待ctx的goroutine也应退出
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before
+	}, time.Second, time.Millisecond)
+}
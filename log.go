@@ -0,0 +1,48 @@
+package zsql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/luoskak/zsql/pkg/utils"
+)
+
+type LogLevel int
+
+const (
+	_ LogLevel = iota
+	// LogSilent 不打印任何语句
+	LogSilent
+	// LogError 只打印出错的语句
+	LogError
+	// LogWarn 打印出错及慢查询语句
+	LogWarn
+	// LogInfo 打印所有语句
+	LogInfo
+)
+
+// trace 按日志级别打印语句，附带耗时、影响行数、库名及调用位置
+func (db *DB) trace(sql string, elapsed time.Duration) {
+	level := db.opts.logLevel
+	if level <= LogSilent {
+		return
+	}
+	st := db.Statement
+	fields := func() string {
+		return fmt.Sprintf("[db:%s] [%.3fms] [rows:%d] %s", db.name, float64(elapsed.Nanoseconds())/1e6, db.RowsAffected, utils.FileWithLineNum())
+	}
+	explain := func() string {
+		if db.opts.parameterizedLog {
+			return sql
+		}
+		return st.explainSQL(sql)
+	}
+	switch {
+	case db.Error != nil && level >= LogError:
+		db.log.Error("%s\n%s\n%v", fields(), explain(), db.Error)
+	case db.opts.slowThreshold > 0 && elapsed > db.opts.slowThreshold && level >= LogWarn:
+		db.log.Warn("%s SLOW SQL >= %v\n%s", fields(), db.opts.slowThreshold, explain())
+	case level >= LogInfo:
+		db.log.Info("%s\n%s", fields(), explain())
+	}
+}
@@ -0,0 +1,292 @@
+package zsql
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsRecorder receives statement and transaction observations
+type MetricsRecorder interface {
+	ObserveQuery(db, operation string, elapsed time.Duration, err error)
+	ObserveTransaction(db, outcome string)
+}
+
+const (
+	TxOutcomeCommit        = "commit"
+	TxOutcomeCommitError   = "commit_error"
+	TxOutcomeRollback      = "rollback"
+	TxOutcomeRollbackError = "rollback_error"
+	TxOutcomeBeginError    = "begin_error"
+)
+
+// DefaultMetricsBuckets 与prometheus默认的桶一致，单位秒
+var DefaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	_ MetricsRecorder = &MetricsCollector{}
+	_ http.Handler    = &MetricsCollector{}
+)
+
+type poolStater interface {
+	Stats() sql.DBStats
+}
+
+// poolRegisterer is implemented by recorders that report pool stats
+type poolRegisterer interface {
+	registerPool(db, role string, pool ConnPool)
+}
+
+type queryKey struct {
+	db, operation string
+}
+
+type queryMetric struct {
+	count   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+type txKey struct {
+	db, outcome string
+}
+
+type poolKey struct {
+	db, role string
+}
+
+// MetricsCollector 在内存中汇总指标，以prometheus文本格式输出，
+// 不依赖prometheus服务
+type MetricsCollector struct {
+	namespace    string
+	buckets      []float64
+	mu           sync.Mutex
+	queries      map[queryKey]*queryMetric
+	transactions map[txKey]uint64
+	pools        map[poolKey]poolStater
+}
+
+// NewMetricsCollector namespace will be zsql when empty, buckets in seconds
+func NewMetricsCollector(namespace string, buckets ...float64) *MetricsCollector {
+	if namespace == "" {
+		namespace = MiddlewareName
+	}
+	if len(buckets) == 0 {
+		buckets = DefaultMetricsBuckets
+	}
+	bs := make([]float64, len(buckets))
+	copy(bs, buckets)
+	sort.Float64s(bs)
+	return &MetricsCollector{
+		namespace:    namespace,
+		buckets:      bs,
+		queries:      make(map[queryKey]*queryMetric),
+		transactions: make(map[txKey]uint64),
+		pools:        make(map[poolKey]poolStater),
+	}
+}
+
+func (mc *MetricsCollector) ObserveQuery(db, operation string, elapsed time.Duration, err error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	key := queryKey{db: db, operation: operation}
+	m, ok := mc.queries[key]
+	if !ok {
+		m = &queryMetric{buckets: make([]uint64, len(mc.buckets))}
+		mc.queries[key] = m
+	}
+	seconds := elapsed.Seconds()
+	m.count++
+	m.sum += seconds
+	if err != nil {
+		m.errors++
+	}
+	for idx, upper := range mc.buckets {
+		if seconds <= upper {
+			m.buckets[idx]++
+		}
+	}
+}
+
+func (mc *MetricsCollector) ObserveTransaction(db, outcome string) {
+	mc.mu.Lock()
+	mc.transactions[txKey{db: db, outcome: outcome}]++
+	mc.mu.Unlock()
+}
+
+func (mc *MetricsCollector) registerPool(db, role string, pool ConnPool) {
+	if stater, ok := pool.(poolStater); ok {
+		mc.mu.Lock()
+		mc.pools[poolKey{db: db, role: role}] = stater
+		mc.mu.Unlock()
+	}
+}
+
+// ServeHTTP writes metrics in the text exposition format
+func (mc *MetricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := mc.WriteTo(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// WriteTo writes metrics in the text exposition format
+func (mc *MetricsCollector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	mc.mu.Lock()
+	mc.writeQueries(cw)
+	mc.writeTransactions(cw)
+	mc.writePools(cw)
+	mc.mu.Unlock()
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (mc *MetricsCollector) writeQueries(w *countWriter) {
+	keys := make([]queryKey, 0, len(mc.queries))
+	for key := range mc.queries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].db != keys[j].db {
+			return keys[i].db < keys[j].db
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	name := mc.namespace + "_queries_total"
+	w.header(name, "counter", "Total number of executed statements.")
+	for _, key := range keys {
+		w.sample(name, mc.queries[key].count, "db", key.db, "operation", key.operation)
+	}
+	name = mc.namespace + "_query_errors_total"
+	w.header(name, "counter", "Total number of statements that returned an error.")
+	for _, key := range keys {
+		w.sample(name, mc.queries[key].errors, "db", key.db, "operation", key.operation)
+	}
+	name = mc.namespace + "_query_duration_seconds"
+	w.header(name, "histogram", "Statement latency in seconds.")
+	for _, key := range keys {
+		m := mc.queries[key]
+		for idx, upper := range mc.buckets {
+			w.sample(name+"_bucket", m.buckets[idx], "db", key.db, "operation", key.operation, "le", strconv.FormatFloat(upper, 'g', -1, 64))
+		}
+		w.sample(name+"_bucket", m.count, "db", key.db, "operation", key.operation, "le", "+Inf")
+		w.sample(name+"_sum", m.sum, "db", key.db, "operation", key.operation)
+		w.sample(name+"_count", m.count, "db", key.db, "operation", key.operation)
+	}
+}
+
+func (mc *MetricsCollector) writeTransactions(w *countWriter) {
+	keys := make([]txKey, 0, len(mc.transactions))
+	for key := range mc.transactions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].db != keys[j].db {
+			return keys[i].db < keys[j].db
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	name := mc.namespace + "_transactions_total"
+	w.header(name, "counter", "Total number of finished transactions by outcome.")
+	for _, key := range keys {
+		w.sample(name, mc.transactions[key], "db", key.db, "outcome", key.outcome)
+	}
+}
+
+func (mc *MetricsCollector) writePools(w *countWriter) {
+	keys := make([]poolKey, 0, len(mc.pools))
+	for key := range mc.pools {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].db != keys[j].db {
+			return keys[i].db < keys[j].db
+		}
+		return keys[i].role < keys[j].role
+	})
+	stats := make([]sql.DBStats, len(keys))
+	for idx, key := range keys {
+		stats[idx] = mc.pools[key].Stats()
+	}
+
+	gauges := []struct {
+		name, typ, help string
+		value           func(sql.DBStats) interface{}
+	}{
+		{"_pool_max_open_connections", "gauge", "Maximum number of open connections.", func(s sql.DBStats) interface{} { return s.MaxOpenConnections }},
+		{"_pool_open_connections", "gauge", "Number of established connections.", func(s sql.DBStats) interface{} { return s.OpenConnections }},
+		{"_pool_in_use_connections", "gauge", "Number of connections currently in use.", func(s sql.DBStats) interface{} { return s.InUse }},
+		{"_pool_idle_connections", "gauge", "Number of idle connections.", func(s sql.DBStats) interface{} { return s.Idle }},
+		{"_pool_wait_count_total", "counter", "Total number of connections waited for.", func(s sql.DBStats) interface{} { return s.WaitCount }},
+		{"_pool_wait_duration_seconds_total", "counter", "Total time blocked waiting for a new connection.", func(s sql.DBStats) interface{} { return s.WaitDuration.Seconds() }},
+	}
+	for _, g := range gauges {
+		name := mc.namespace + g.name
+		w.header(name, g.typ, g.help)
+		for idx, key := range keys {
+			w.sample(name, g.value(stats[idx]), "db", key.db, "role", key.role)
+		}
+	}
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) write(s string) {
+	if cw.err != nil {
+		return
+	}
+	n, err := cw.w.WriteString(s)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+func (cw *countWriter) header(name, typ, help string) {
+	cw.write("# HELP " + name + " " + help + "\n")
+	cw.write("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample labels are pairs of name and value
+func (cw *countWriter) sample(name string, value interface{}, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	switch v := value.(type) {
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		b.WriteString(fmt.Sprint(v))
+	}
+	b.WriteByte('\n')
+	cw.write(b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
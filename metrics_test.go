@@ -0,0 +1,27 @@
+package zsql
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsCollectorWriteTo(t *testing.T) {
+	mc := NewMetricsCollector("", 0.1, 1)
+	mc.ObserveQuery("default", "select", 50*time.Millisecond, nil)
+	mc.ObserveQuery("default", "select", 500*time.Millisecond, errors.New("boom"))
+	mc.ObserveTransaction("default", TxOutcomeCommit)
+
+	var buf bytes.Buffer
+	_, err := mc.WriteTo(&buf)
+	assert.Nil(t, err)
+	out := buf.String()
+	assert.Contains(t, out, `zsql_queries_total{db="default",operation="select"} 2`)
+	assert.Contains(t, out, `zsql_query_errors_total{db="default",operation="select"} 1`)
+	assert.Contains(t, out, `zsql_query_duration_seconds_bucket{db="default",operation="select",le="0.1"} 1`)
+	assert.Contains(t, out, `zsql_query_duration_seconds_bucket{db="default",operation="select",le="+Inf"} 2`)
+	assert.Contains(t, out, `zsql_transactions_total{db="default",outcome="commit"} 1`)
+}
@@ -46,6 +46,9 @@ func (m *Middleware) Init(opt []mist.Option) {
 		opts.cacheStore = &sync.Map{}
 	}
 
+	if m.dbs == nil {
+		m.dbs = make(map[string]*DB)
+	}
 	if len(opts.dbOpts) == 0 {
 		panic("has no addressed mysql")
 	}
@@ -54,8 +57,11 @@ func (m *Middleware) Init(opt []mist.Option) {
 	for _, dbOpt := range opts.dbOpts {
 		dbName := dbOpt.name
 		db := &DB{
+			name:          dbName,
+			dialect:       dbOpt.driverName,
 			opts:          &opts,
 			clausesCaller: opts.clauseCaller(dbOpt.driverName),
+			callbacks:     initializeCallbacks(),
 		}
 		db.log = logger.NewLogger("Middleware:%s->%s", MiddlewareName, dbName)
 		// TODO: 将driver分离
@@ -92,11 +98,10 @@ func (m *Middleware) Init(opt []mist.Option) {
 				errs = fmt.Errorf("%v; %s read got %w", errs, dbName, err)
 			} else {
 				db.rConn = stdlib.OpenDB(*rc)
-				db.listener = &pgxListener{
-					openFunc: func(ctx context.Context) (*pgx.Conn, error) {
-						return pgx.Connect(ctx, dbOpt.readAddress)
-					},
-				}
+				readAddress := dbOpt.readAddress
+				db.listener = newPgxListener(func(ctx context.Context) (*pgx.Conn, error) {
+					return pgx.Connect(ctx, readAddress)
+				}, db.log, opts.listenMinBackoff, opts.listenMaxBackoff)
 			}
 			wc, err := pgx.ParseConfig(dbOpt.writeAddress)
 			if err != nil {
@@ -113,9 +118,22 @@ func (m *Middleware) Init(opt []mist.Option) {
 		}
 
 	}
+	for name, db := range m.dbs {
+		for _, plugin := range opts.plugins {
+			if err := db.Use(plugin); err != nil {
+				errs = fmt.Errorf("%v; %s plugin %s got %w", errs, name, plugin.Name(), err)
+			}
+		}
+	}
 	if errs != nil {
 		panic(errs)
 	}
+	if pr, ok := opts.metrics.(poolRegisterer); ok {
+		for name, db := range m.dbs {
+			pr.registerPool(name, "read", db.rConn)
+			pr.registerPool(name, "write", db.wConn)
+		}
+	}
 	if _, hasDefault := m.dbs["default"]; !hasDefault {
 		m.dbs["default"] = m.dbs[opts.dbOpts[0].name]
 	}
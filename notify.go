@@ -2,56 +2,441 @@ package zsql
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/luoskak/logger"
 	"github.com/luoskak/plant/pkg/rxjs"
 	"github.com/luoskak/plant/pkg/rxjs/abstract"
 )
 
 var (
 	ErrInvalidConnForListen = errors.New("conn does not support LISTEN / NOTIFY")
+	// ErrInvalidNotifyChannel 频道名为空、超过63字节或包含\x00
+	ErrInvalidNotifyChannel = errors.New("invalid notify channel")
+	// ErrNotifyPayloadTooLarge postgres要求payload小于8000字节
+	ErrNotifyPayloadTooLarge = errors.New("notify payload must be shorter than 8000 bytes")
 )
 
-// listener support by pgx on postgres
+const (
+	maxNotifyChannelLen = 63
+	maxNotifyPayloadLen = 8000
+
+	defaultListenMinBackoff = 500 * time.Millisecond
+	defaultListenMaxBackoff = 30 * time.Second
+)
+
+// ListenReconnected 断线重连并重新LISTEN后发送给该频道的订阅者，
+// 断线期间的通知已丢失，订阅者应据此重新同步状态
+type ListenReconnected struct {
+	Channel string
+	At      time.Time
+}
+
+// listener support by pgx on postgres,
+// all channels share one connection which reconnects with backoff
 type pgxListener struct {
-	openFunc func(ctx context.Context) (*pgx.Conn, error)
+	openFunc   func(ctx context.Context) (*pgx.Conn, error)
+	log        *logger.Logger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu   sync.Mutex
+	subs map[string]map[*listenSubscriber]struct{}
+	// wake 订阅变化时唤醒等待中的连接以重新LISTEN
+	wake   chan struct{}
+	cancel context.CancelFunc
+	crdb   crdbDetector
+}
+
+type listenSubscriber struct {
+	channel  string
+	observer rxjs.Observer
+	deliver  func(n *pgconn.Notification)
+	// reconnects 是否接收ListenReconnected，Listen只发送string不接收
+	reconnects bool
+	done       chan struct{}
+}
+
+func newPgxListener(openFunc func(ctx context.Context) (*pgx.Conn, error), log *logger.Logger, minBackoff, maxBackoff time.Duration) *pgxListener {
+	if minBackoff <= 0 {
+		minBackoff = defaultListenMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = defaultListenMaxBackoff
+	}
+	return &pgxListener{
+		openFunc:   openFunc,
+		log:        log,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		subs:       make(map[string]map[*listenSubscriber]struct{}),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Notification 通知的完整信息
+type Notification struct {
+	Channel string
+	PID     uint32
+	Payload string
+	// Value 解码后的payload，未指定解码时为nil
+	Value interface{}
 }
 
+// NotificationError 解码失败时作为普通事件发送，不会结束订阅
+type NotificationError struct {
+	Notification *Notification
+	Err          error
+}
+
+func (e *NotificationError) Error() string {
+	return fmt.Sprintf("decode notification on %s from %d: %v", e.Notification.Channel, e.Notification.PID, e.Err)
+}
+
+func (e *NotificationError) Unwrap() error {
+	return e.Err
+}
+
+// NotificationDecoder 解码payload
+type NotificationDecoder func(payload []byte) (interface{}, error)
+
+// Listen 订阅频道，只发送string类型的payload，ctx结束时完成；
+// 不发送ListenReconnected，需要感知重连时使用ListenNotifications
 func (db *DB) Listen(ctx context.Context, channel string) (abstract.Observable, error) {
+	return db.listen(ctx, channel, false, func(observer rxjs.Observer, n *pgconn.Notification) {
+		observer.Next(n.Payload)
+	})
+}
+
+// ListenNotifications 同Listen，发送*Notification，重连后发送ListenReconnected
+func (db *DB) ListenNotifications(ctx context.Context, channel string) (abstract.Observable, error) {
+	return db.ListenDecode(ctx, channel, nil)
+}
+
+// ListenDecode 使用decode解码payload后发送*Notification，
+// 解码失败发送*NotificationError，重连后发送ListenReconnected
+func (db *DB) ListenDecode(ctx context.Context, channel string, decode NotificationDecoder) (abstract.Observable, error) {
+	return db.listen(ctx, channel, true, func(observer rxjs.Observer, n *pgconn.Notification) {
+		notification := &Notification{
+			Channel: n.Channel,
+			PID:     n.PID,
+			Payload: n.Payload,
+		}
+		if decode != nil {
+			v, err := decode([]byte(n.Payload))
+			if err != nil {
+				observer.Next(&NotificationError{Notification: notification, Err: err})
+				return
+			}
+			notification.Value = v
+		}
+		observer.Next(notification)
+	})
+}
+
+// ListenJSON 将payload按JSON解码为与typ相同类型的新值，typ如 &Order{}
+// 则Notification.Value为*Order
+func (db *DB) ListenJSON(ctx context.Context, channel string, typ interface{}) (abstract.Observable, error) {
+	rt := reflect.TypeOf(typ)
+	if rt == nil {
+		return nil, ErrInvalidValue
+	}
+	isPtr := rt.Kind() == reflect.Ptr
+	if isPtr {
+		rt = rt.Elem()
+	}
+	return db.ListenDecode(ctx, channel, func(payload []byte) (interface{}, error) {
+		v := reflect.New(rt)
+		if err := json.Unmarshal(payload, v.Interface()); err != nil {
+			return nil, err
+		}
+		if isPtr {
+			return v.Interface(), nil
+		}
+		return v.Elem().Interface(), nil
+	})
+}
+
+func (db *DB) listen(ctx context.Context, channel string, reconnects bool, deliver func(observer rxjs.Observer, n *pgconn.Notification)) (abstract.Observable, error) {
 	tx := db.getInstance()
-	if tx.listener == nil {
-		return nil, ErrInvalidConnForListen
+	if !tx.nativeListen(ctx) {
+		return tx.pollListen(ctx, channel, deliver), nil
 	}
+	l := tx.listener
 	return rxjs.Observable(func(observer rxjs.Observer) {
-		conn, err := db.listener.openFunc(ctx)
-		if err != nil {
-			observer.Err(err)
-			return
+		sub := &listenSubscriber{
+			channel:  channel,
+			observer: observer,
+			deliver: func(n *pgconn.Notification) {
+				deliver(observer, n)
+			},
+			reconnects: reconnects,
+			done:       make(chan struct{}),
 		}
-		defer func() {
-			err := conn.Close(ctx)
-			if err != nil {
-				observer.Err(err)
+		l.subscribe(sub)
+		defer l.unsubscribe(sub)
+		select {
+		case <-ctx.Done():
+		case <-sub.done:
+		}
+	}), nil
+}
+
+func (l *pgxListener) subscribe(sub *listenSubscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	subs, ok := l.subs[sub.channel]
+	if !ok {
+		subs = make(map[*listenSubscriber]struct{})
+		l.subs[sub.channel] = subs
+	}
+	subs[sub] = struct{}{}
+	if l.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		l.cancel = cancel
+		go l.run(ctx)
+	}
+	l.notifyChanged()
+}
+
+func (l *pgxListener) unsubscribe(sub *listenSubscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if subs, ok := l.subs[sub.channel]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(l.subs, sub.channel)
+		}
+	}
+	if len(l.subs) == 0 && l.cancel != nil {
+		l.cancel()
+		l.cancel = nil
+		return
+	}
+	l.notifyChanged()
+}
+
+func (l *pgxListener) notifyChanged() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *pgxListener) channels() map[string]struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	channels := make(map[string]struct{}, len(l.subs))
+	for channel := range l.subs {
+		channels[channel] = struct{}{}
+	}
+	return channels
+}
+
+func (l *pgxListener) subscribers(channel string) []*listenSubscriber {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	subs := make([]*listenSubscriber, 0, len(l.subs[channel]))
+	for sub := range l.subs[channel] {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// run 持有连接的唯一goroutine，没有订阅者时退出
+func (l *pgxListener) run(ctx context.Context) {
+	var (
+		conn      *pgx.Conn
+		listening map[string]struct{}
+		connected bool
+		attempt   int
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if conn == nil {
+			c, err := l.openFunc(ctx)
+			if err == nil && c.PgConn().ParameterStatus("crdb_version") != "" {
+				c.Close(ctx)
+				l.fail(ErrInvalidConnForListen)
 				return
 			}
-		}()
-		if conn.PgConn().ParameterStatus("crdb_version") != "" {
-			observer.Err(ErrInvalidConnForListen)
-			return
+			if err != nil {
+				if ctx.Err() == nil {
+					l.log.Error("listen connect failed: %v", err)
+				}
+				l.sleep(ctx, attempt)
+				attempt++
+				continue
+			}
+			conn, listening, attempt = c, make(map[string]struct{}), 0
+			if err := l.sync(ctx, conn, listening); err != nil {
+				l.log.Error("listen failed: %v", err)
+				conn.Close(ctx)
+				conn = nil
+				continue
+			}
+			if connected {
+				l.reconnected(listening)
+			}
+			connected = true
+		} else if err := l.sync(ctx, conn, listening); err != nil {
+			if ctx.Err() == nil {
+				l.log.Error("listen failed: %v", err)
+			}
+			conn.Close(context.Background())
+			conn = nil
+			continue
 		}
-		_, err = conn.Exec(ctx, "listen "+channel)
+
+		waitCtx, cancel := context.WithCancel(ctx)
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-l.wake:
+				cancel()
+			case <-stop:
+			}
+		}()
+		notification, err := conn.WaitForNotification(waitCtx)
+		close(stop)
+		woken := waitCtx.Err() != nil
+		cancel()
 		if err != nil {
-			observer.Err(err)
-			return
-		}
-		for {
-			notification, err := conn.WaitForNotification(ctx)
-			if err != nil {
-				observer.Err(err)
+			if ctx.Err() != nil {
 				return
 			}
-			observer.Next(notification.Payload)
+			if woken && !conn.IsClosed() {
+				continue
+			}
+			l.log.Error("listen connection lost: %v", err)
+			conn.Close(context.Background())
+			conn = nil
+			continue
 		}
-	}), nil
+		for _, sub := range l.subscribers(notification.Channel) {
+			sub.deliver(notification)
+		}
+	}
+}
+
+// reconnected 通知重新LISTEN的频道上接收重连事件的订阅者
+func (l *pgxListener) reconnected(listening map[string]struct{}) {
+	at := time.Now()
+	for channel := range listening {
+		for _, sub := range l.subscribers(channel) {
+			if sub.reconnects {
+				sub.observer.Next(ListenReconnected{Channel: channel, At: at})
+			}
+		}
+	}
+}
+
+// sync 对新增频道LISTEN，对无订阅者的频道UNLISTEN
+func (l *pgxListener) sync(ctx context.Context, conn *pgx.Conn, listening map[string]struct{}) error {
+	channels := l.channels()
+	for channel := range channels {
+		if _, ok := listening[channel]; ok {
+			continue
+		}
+		if _, err := conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+		listening[channel] = struct{}{}
+	}
+	for channel := range listening {
+		if _, ok := channels[channel]; ok {
+			continue
+		}
+		if _, err := conn.Exec(ctx, "unlisten "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+		delete(listening, channel)
+	}
+	return nil
+}
+
+// fail 不可恢复的错误，结束所有订阅，之后的订阅重新启动run
+func (l *pgxListener) fail(err error) {
+	l.mu.Lock()
+	if l.cancel != nil {
+		l.cancel()
+		l.cancel = nil
+	}
+	var subs []*listenSubscriber
+	for _, channelSubs := range l.subs {
+		for sub := range channelSubs {
+			subs = append(subs, sub)
+		}
+	}
+	l.subs = make(map[string]map[*listenSubscriber]struct{})
+	l.mu.Unlock()
+	for _, sub := range subs {
+		sub.observer.Err(err)
+		close(sub.done)
+	}
+}
+
+// sleep 指数退避，附带至多一半的随机抖动
+func (l *pgxListener) sleep(ctx context.Context, attempt int) {
+	backoff := l.minBackoff
+	for i := 0; i < attempt && backoff < l.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > l.maxBackoff {
+		backoff = l.maxBackoff
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Notify 通过pg_notify发送通知，频道及payload均为绑定参数，
+// 不支持LISTEN的库写入通知表；
+// 在事务中调用时与postgres一致，提交后才会送达，回滚则丢弃
+func (db *DB) Notify(ctx context.Context, channel, payload string) error {
+	if err := validateNotify(channel, payload); err != nil {
+		return err
+	}
+	tx := db.contextSession(ctx)
+	if !tx.nativeListen(ctx) {
+		return tx.pollNotify(channel, payload)
+	}
+	return tx.Exec("select pg_notify($1, $2)", channel, payload).Error
+}
+
+// NotifyJSON 将v序列化为JSON作为payload发送
+func (db *DB) NotifyJSON(ctx context.Context, channel string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.Notify(ctx, channel, string(payload))
+}
+
+func validateNotify(channel, payload string) error {
+	if channel == "" || len(channel) > maxNotifyChannelLen || strings.IndexByte(channel, 0) >= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidNotifyChannel, channel)
+	}
+	if len(payload) >= maxNotifyPayloadLen {
+		return fmt.Errorf("%w: got %d", ErrNotifyPayloadTooLarge, len(payload))
+	}
+	return nil
 }
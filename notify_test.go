@@ -0,0 +1,238 @@
+package zsql
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+type testObserver struct {
+	values []interface{}
+	err    error
+}
+
+func (o *testObserver) Next(v interface{}) {
+	o.values = append(o.values, v)
+}
+
+func (o *testObserver) Complete() {}
+
+func (o *testObserver) Err(err error) {
+	o.err = err
+}
+
+func TestListenerResubscribeAfterFail(t *testing.T) {
+	opened := make(chan context.Context, 4)
+	l := newPgxListener(func(ctx context.Context) (*pgx.Conn, error) {
+		opened <- ctx
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, nil, 0, 0)
+	waitOpen := func() context.Context {
+		select {
+		case ctx := <-opened:
+			return ctx
+		case <-time.After(time.Second):
+			t.Fatal("listener did not connect")
+			return nil
+		}
+	}
+
+	first := &listenSubscriber{channel: "a", observer: &testObserver{}, done: make(chan struct{})}
+	l.subscribe(first)
+	runCtx := waitOpen()
+	l.fail(ErrInvalidConnForListen)
+	<-first.done
+	assert.ErrorIs(t, first.observer.(*testObserver).err, ErrInvalidConnForListen)
+	assert.NotNil(t, runCtx.Err())
+
+	// 失败的订阅者退出前就有新的订阅
+	second := &listenSubscriber{channel: "a", observer: &testObserver{}, done: make(chan struct{})}
+	l.subscribe(second)
+	l.unsubscribe(first)
+	runCtx = waitOpen()
+	assert.Nil(t, runCtx.Err())
+
+	l.fail(ErrInvalidConnForListen)
+	<-second.done
+	l.unsubscribe(second)
+	assert.Nil(t, l.cancel)
+}
+
+// nextFunc 只关心Next的订阅者
+type nextFunc func(v interface{})
+
+func (f nextFunc) Next(v interface{}) {
+	f(v)
+}
+
+// newListenDB 支持LISTEN的测试库，连接一直阻塞，通知由测试直接投递给订阅者
+func newListenDB() *DB {
+	db, _ := newFakeDB(func(sql string, args []interface{}) fakedb.Result {
+		return fakedb.Result{Columns: []string{"version"}, Rows: [][]interface{}{{"PostgreSQL 14.1"}}}
+	})
+	db.listener = newPgxListener(func(ctx context.Context) (*pgx.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, db.log, 0, 0)
+	return db
+}
+
+// waitSubscribers 等待频道上有n个订阅者
+func waitSubscribers(t *testing.T, db *DB, channel string, n int) []*listenSubscriber {
+	assert.Eventually(t, func() bool {
+		return len(db.listener.subscribers(channel)) == n
+	}, time.Second, time.Millisecond)
+	return db.listener.subscribers(channel)
+}
+
+func TestListenReconnectedOnlyOnTypedStreams(t *testing.T) {
+	db := newListenDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payloads := make(chan string, 4)
+	listen, err := db.Listen(ctx, "a")
+	assert.Nil(t, err)
+	listen.Subscribe(nextFunc(func(v interface{}) {
+		// 只处理string的旧订阅者
+		payloads <- v.(string)
+	}))
+	typed := make(chan interface{}, 4)
+	notifications, err := db.ListenNotifications(ctx, "a")
+	assert.Nil(t, err)
+	notifications.Subscribe(nextFunc(func(v interface{}) {
+		typed <- v
+	}))
+
+	subs := waitSubscribers(t, db, "a", 2)
+	db.listener.reconnected(map[string]struct{}{"a": {}})
+	for _, sub := range subs {
+		sub.deliver(&pgconn.Notification{Channel: "a", Payload: "hello"})
+	}
+
+	assert.Equal(t, "hello", <-payloads)
+	select {
+	case v := <-payloads:
+		t.Fatalf("unexpected value %v", v)
+	default:
+	}
+	assert.Equal(t, "a", (<-typed).(ListenReconnected).Channel)
+	assert.Equal(t, "hello", (<-typed).(*Notification).Payload)
+}
+
+func TestNotifyKeepsCallerContext(t *testing.T) {
+	db, source := newFakeDB(func(sql string, args []interface{}) fakedb.Result {
+		if sql == "select version()" {
+			return fakedb.Result{Columns: []string{"version"}, Rows: [][]interface{}{{"PostgreSQL 14.1"}}}
+		}
+		return fakedb.Result{RowsAffected: 1}
+	})
+	type ctxKey struct{}
+	txCtx := context.WithValue(context.Background(), ctxKey{}, "tx")
+	notifyCtx := context.WithValue(context.Background(), ctxKey{}, "notify")
+
+	tx := db.WithContext(txCtx).Begin()
+	assert.Nil(t, tx.Error)
+	assert.Nil(t, tx.Notify(notifyCtx, "a", "polled"))
+	db.listener = newPgxListener(nil, db.log, 0, 0)
+	tx.listener = db.listener
+	chained := tx.Where("id", "=", 1)
+	assert.Nil(t, chained.Notify(notifyCtx, "a", "native"))
+	// 调用方的Context及子句不受影响
+	assert.Equal(t, txCtx, tx.Statement.Context)
+	assert.Contains(t, tx.Statement.Clauses, "WHERE")
+	assert.Nil(t, tx.Commit().Error)
+
+	sqls := source.SQL()
+	assert.Equal(t, fakedb.Begin, sqls[0])
+	assert.Contains(t, sqls[1], "INSERT INTO zsql_notifications")
+	assert.Equal(t, "select pg_notify($1, $2)", sqls[len(sqls)-2])
+	assert.Equal(t, fakedb.Commit, sqls[len(sqls)-1])
+}
+
+type notifyOrder struct {
+	ID    int64  `json:"id"`
+	State string `json:"state"`
+}
+
+func TestListenDecodeErrorsAreNotFatal(t *testing.T) {
+	db := newListenDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ptrs := make(chan interface{}, 4)
+	observable, err := db.ListenJSON(ctx, "orders", &notifyOrder{})
+	assert.Nil(t, err)
+	observable.Subscribe(nextFunc(func(v interface{}) { ptrs <- v }))
+	values := make(chan interface{}, 4)
+	observable, err = db.ListenJSON(ctx, "orders", notifyOrder{})
+	assert.Nil(t, err)
+	observable.Subscribe(nextFunc(func(v interface{}) { values <- v }))
+
+	subs := waitSubscribers(t, db, "orders", 2)
+	for _, payload := range []string{`{"id": "bad"`, `{"id": 7, "state": "paid"}`} {
+		for _, sub := range subs {
+			sub.deliver(&pgconn.Notification{PID: 42, Channel: "orders", Payload: payload})
+		}
+	}
+
+	for _, ch := range []chan interface{}{ptrs, values} {
+		nerr, ok := (<-ch).(*NotificationError)
+		if assert.True(t, ok) {
+			assert.Equal(t, `{"id": "bad"`, nerr.Notification.Payload)
+			assert.Equal(t, uint32(42), nerr.Notification.PID)
+			assert.Contains(t, nerr.Error(), "decode notification on orders from 42")
+			assert.NotNil(t, errors.Unwrap(nerr))
+		}
+	}
+	n := (<-ptrs).(*Notification)
+	assert.Equal(t, &notifyOrder{ID: 7, State: "paid"}, n.Value)
+	assert.Equal(t, "orders", n.Channel)
+	assert.Equal(t, notifyOrder{ID: 7, State: "paid"}, (<-values).(*Notification).Value)
+
+	// 订阅未结束，之后的通知继续送达
+	for _, sub := range subs {
+		sub.deliver(&pgconn.Notification{Channel: "orders", Payload: `{"id": 8}`})
+	}
+	assert.Equal(t, &notifyOrder{ID: 8}, (<-ptrs).(*Notification).Value)
+
+	_, err = db.ListenJSON(ctx, "orders", nil)
+	assert.Equal(t, ErrInvalidValue, err)
+}
+
+func TestListenDecode(t *testing.T) {
+	db := newListenDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	values := make(chan interface{}, 4)
+	observable, err := db.ListenDecode(ctx, "n", func(payload []byte) (interface{}, error) {
+		return strconv.Atoi(string(payload))
+	})
+	assert.Nil(t, err)
+	observable.Subscribe(nextFunc(func(v interface{}) { values <- v }))
+	raw := make(chan interface{}, 4)
+	observable, err = db.ListenNotifications(ctx, "n")
+	assert.Nil(t, err)
+	observable.Subscribe(nextFunc(func(v interface{}) { raw <- v }))
+
+	subs := waitSubscribers(t, db, "n", 2)
+	for _, payload := range []string{"x", "3"} {
+		for _, sub := range subs {
+			sub.deliver(&pgconn.Notification{Channel: "n", Payload: payload})
+		}
+	}
+	var numErr *strconv.NumError
+	assert.True(t, errors.As((<-values).(error), &numErr))
+	assert.Equal(t, 3, (<-values).(*Notification).Value)
+	assert.Equal(t, &Notification{Channel: "n", Payload: "x"}, <-raw)
+	assert.Equal(t, &Notification{Channel: "n", Payload: "3"}, <-raw)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/luoskak/mist"
+	"github.com/luoskak/zsql/pkg/parser"
 	"github.com/luoskak/zsql/pkg/schema"
 )
 
@@ -17,6 +18,25 @@ type mwOptions struct {
 	namingStrategy schema.Namer
 	cacheStore     *sync.Map
 	clauseCaller   func(driverName string) func(opertion string) []string
+	metrics        MetricsRecorder
+	tracer         Tracer
+	sqlCommenter   bool
+	logLevel       LogLevel
+	slowThreshold  time.Duration
+	// parameterizedLog 日志中不展开参数
+	parameterizedLog bool
+	sensitiveColumns map[string]struct{}
+	sensitiveMask    func(value interface{}) string
+	redactor         parser.Redactor
+	plugins          []Plugin
+	listenMinBackoff time.Duration
+	listenMaxBackoff time.Duration
+	notifyTable      string
+	pollInterval     time.Duration
+	notifyRetention  time.Duration
+	notifyLookback   time.Duration
+	// strictIdentifiers 所有查询启用严格列名校验，见DB.Strict
+	strictIdentifiers bool
 }
 
 var defaultMwOptions = mwOptions{
@@ -25,6 +45,7 @@ var defaultMwOptions = mwOptions{
 	maxLifeTime:    time.Hour,
 	namingStrategy: schema.NamingStrategy{},
 	clauseCaller:   clausesDefaultCaller,
+	logLevel:       LogInfo,
 }
 
 type dbOptions struct {
@@ -49,6 +70,147 @@ func MaxOpen(count int) mist.Option {
 	})
 }
 
+// Metrics 记录每个库每种操作的次数、耗时及事务结果，
+// 若recorder为*MetricsCollector则同时汇总连接池状态
+func Metrics(recorder MetricsRecorder) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.metrics = recorder
+	})
+}
+
+// Tracing 为每条语句及事务生成span
+func Tracing(tracer Tracer) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.tracer = tracer
+	})
+}
+
+// SQLCommenter 在语句末尾追加 /*traceparent='...',route='...'*/ 注释，
+// 标签来自ContextWithSQLComment及span的traceparent
+func SQLCommenter(enable bool) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.sqlCommenter = enable
+	})
+}
+
+// Log 设置语句日志级别，默认LogInfo
+func Log(level LogLevel) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.logLevel = level
+	})
+}
+
+// SlowThreshold 超过该耗时的语句以Warn级别打印，0为不区分
+func SlowThreshold(threshold time.Duration) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.slowThreshold = threshold
+	})
+}
+
+// ParameterizedLog 打印带占位符的语句而不是展开参数值
+func ParameterizedLog(enable bool) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.parameterizedLog = enable
+	})
+}
+
+// SensitiveColumns 注册需要在日志中脱敏的列名，不区分大小写
+func SensitiveColumns(columns ...string) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		sensitive := make(map[string]struct{}, len(opts.sensitiveColumns)+len(columns))
+		for column := range opts.sensitiveColumns {
+			sensitive[column] = struct{}{}
+		}
+		for _, column := range columns {
+			sensitive[strings.ToLower(column)] = struct{}{}
+		}
+		opts.sensitiveColumns = sensitive
+	})
+}
+
+// SensitiveMask 敏感参数的替换方式，默认parser.Mask，可使用parser.Hash
+func SensitiveMask(mask func(value interface{}) string) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.sensitiveMask = mask
+	})
+}
+
+// Redaction 自定义脱敏，优先于SensitiveColumns及字段标签
+func Redaction(redactor parser.Redactor) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.redactor = redactor
+	})
+}
+
+// StrictIdentifiers 所有查询启用严格模式，列名须为模型的列或NameMapper中的名称，
+// 否则返回IdentifierError，可通过DB.Strict追加允许的列
+func StrictIdentifiers() mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.strictIdentifiers = true
+	})
+}
+
+// Plugins 初始化时为每个库安装插件
+func Plugins(plugins ...Plugin) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.plugins = append(opts.plugins, plugins...)
+	})
+}
+
+// ListenBackoff LISTEN断线重连的退避区间，默认500ms到30s
+func ListenBackoff(min, max time.Duration) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.listenMinBackoff = min
+		opts.listenMaxBackoff = max
+	})
+}
+
+// NotifyTable 不支持LISTEN / NOTIFY的库(mysql、CockroachDB)使用的通知表，
+// 默认zsql_notifications，可通过DB.InstallNotifyTable创建
+func NotifyTable(table string) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.notifyTable = table
+	})
+}
+
+// PollInterval 轮询通知表的间隔，默认1s
+func PollInterval(interval time.Duration) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.pollInterval = interval
+	})
+}
+
+// NotifyRetention 已消费的通知保留时长，默认1h
+func NotifyRetention(retention time.Duration) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.notifyRetention = retention
+	})
+}
+
+// NotifyLookback 轮询时重新扫描的时长，覆盖写入到提交的最长时间，
+// 期间提交的较小id的通知仍会投递，默认1m
+func NotifyLookback(lookback time.Duration) mist.Option {
+	return mist.NewFuncMyOption(MiddlewareName, func(i mist.Options) {
+		opts := i.(*mwOptions)
+		opts.notifyLookback = lookback
+	})
+}
+
 // name will set to be default when empty
 func MysqlAddress(name, read, write string) mist.Option {
 	if read == "" || write == "" {
@@ -107,8 +269,22 @@ func clausesDefaultCaller(driver string) func(operation string) []string {
 			switch operation {
 			case "SELECT":
 				return []string{
+					"WITH",
+					"JOIN",
 					"WHERE",
 					"GROUP BY",
+					"HAVING",
+					"ORDER BY",
+					"LIMIT",
+					"FOR",
+				}
+			case "UPDATE", "DELETE":
+				return []string{
+					"WITH",
+				}
+			case "UNION":
+				return []string{
+					"WITH",
 					"ORDER BY",
 					"LIMIT",
 				}
@@ -121,8 +297,22 @@ func clausesDefaultCaller(driver string) func(operation string) []string {
 			switch operation {
 			case "SELECT":
 				return []string{
+					"WITH",
+					"JOIN",
 					"WHERE",
 					"GROUP BY",
+					"HAVING",
+					"ORDER BY",
+					"LIMIT",
+					"FOR",
+				}
+			case "UPDATE", "DELETE":
+				return []string{
+					"WITH",
+				}
+			case "UNION":
+				return []string{
+					"WITH",
 					"ORDER BY",
 					"LIMIT",
 				}
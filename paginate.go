@@ -0,0 +1,218 @@
+package zsql
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/luoskak/zsql/pkg/schema"
+)
+
+// windowTotalColumn COUNT(*) OVER()的列名，Scan时写入Statement.windowTotal
+const windowTotalColumn = "zsql_total"
+
+// ErrInvalidPerPage 每页数量必须大于0
+var ErrInvalidPerPage = errors.New("per page must be greater than 0")
+
+// Page 分页信息
+type Page struct {
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int64 `json:"total"`
+	Pages   int   `json:"pages"`
+	HasNext bool  `json:"has_next"`
+}
+
+// PaginateOptions 为nil时先计数再查询数据
+type PaginateOptions struct {
+	// Parallel 计数与数据查询并行执行，事务中只有一个连接，仍按顺序执行
+	Parallel bool
+	// Window 在数据查询中附加 COUNT(*) OVER() 取得总数，只执行一次查询，
+	// 仅支持结构体切片，语句无法附加时或当前页为空时另行计数
+	Window bool
+}
+
+// Paginate 查询第page页数据到dest并返回分页信息，page从1开始，
+// 计数语句去掉ORDER BY、LIMIT及FOR，以子查询包裹，GROUP BY时为分组数
+func (db *DB) Paginate(page, perPage int, dest interface{}, opts ...*PaginateOptions) (Page, error) {
+	tx := db.getInstance()
+	var opt PaginateOptions
+	if len(opts) > 0 && opts[0] != nil {
+		opt = *opts[0]
+	}
+	if page < 1 {
+		page = 1
+	}
+	result := Page{Page: page, PerPage: perPage}
+	if perPage < 1 {
+		return result, tx.AddError(ErrInvalidPerPage)
+	}
+	if tx.Error != nil {
+		return result, tx.Error
+	}
+
+	// 严格模式按模型校验列名，构建计数语句前先解析模型
+	if tx.Statement.Schema == nil {
+		model := tx.Statement.Model
+		if model == nil {
+			model = dest
+		}
+		if err := tx.Statement.Parse(model); err != nil && !errors.Is(err, schema.ErrUnsupportedDataType) {
+			return result, tx.AddError(err)
+		}
+	}
+
+	// Find执行后语句及参数会被清空，计数语句需先构建
+	countSQL, countVals := tx.countSQL()
+	if tx.Error != nil {
+		return result, tx.Error
+	}
+	counter := tx.session(countSQL, countVals)
+
+	var total int64
+	if opt.Window && isStructSlice(dest) {
+		if sql, ok := withWindowTotal(tx.Statement.SQL.String()); ok {
+			total = -1
+			tx.Statement.SQL.Reset()
+			tx.Statement.SQL.WriteString(sql)
+			tx.Statement.windowTotal = &total
+			tx.Paging(page, perPage).Find(dest)
+			tx.Statement.windowTotal = nil
+			if tx.Error != nil {
+				return result, tx.Error
+			}
+			// 当前页为空时无法取得总数，另行计数
+			if total < 0 && counter.Find(&total).Error != nil {
+				return result, tx.AddError(counter.Error)
+			}
+			return result.withTotal(total), nil
+		}
+	}
+
+	if _, inTx := tx.Statement.ConnPool.(TxCommitter); opt.Parallel && !inTx {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter.Find(&total)
+		}()
+		tx.Paging(page, perPage).Find(dest)
+		wg.Wait()
+		if counter.Error != nil {
+			tx.AddError(counter.Error)
+		}
+	} else {
+		if counter.Find(&total).Error != nil {
+			return result, tx.AddError(counter.Error)
+		}
+		tx.Paging(page, perPage).Find(dest)
+	}
+	return result.withTotal(total), tx.Error
+}
+
+func (p Page) withTotal(total int64) Page {
+	p.Total = total
+	p.Pages = int((total + int64(p.PerPage) - 1) / int64(p.PerPage))
+	p.HasNext = p.Page < p.Pages
+	return p
+}
+
+// countSQL 构建计数语句，不影响原语句
+func (db *DB) countSQL() (string, []interface{}) {
+	st := db.Statement
+	stmt := st.derive()
+	stmt.Vals = append([]interface{}{}, st.Vals...)
+	stmt.SQL.WriteString(st.SQL.String())
+	var clauses []string
+	for _, name := range st.BuildClauses {
+		switch name {
+		case "ORDER BY", "LIMIT", "FOR":
+		default:
+			clauses = append(clauses, name)
+		}
+	}
+	stmt.Build(clauses...)
+	return "SELECT COUNT(*) FROM (" + stmt.SQL.String() + ") zsql_count", stmt.Vals
+}
+
+// session 使用相同连接及Context的独立查询
+func (db *DB) session(sql string, vals []interface{}) *DB {
+	tx := &DB{
+		rConn:         db.rConn,
+		wConn:         db.wConn,
+		opts:          db.opts,
+		name:          db.name,
+		dialect:       db.dialect,
+		log:           db.log,
+		clausesCaller: db.clausesCaller,
+		listener:      db.listener,
+		callbacks:     db.callbacks,
+	}
+	tx.Statement = &Statement{
+		Context:    db.Statement.Context,
+		DB:         tx,
+		Clauses:    make(map[string]Clause),
+		NameMapper: make(map[string]string),
+		ConnPool:   db.Statement.ConnPool,
+	}
+	tx.Statement.SQL.WriteString(sql)
+	tx.Statement.Vals = vals
+	return tx
+}
+
+const windowTotalSelect = ", COUNT(*) OVER() AS " + windowTotalColumn
+
+// withWindowTotal 在最外层FROM之前插入COUNT(*) OVER()
+func withWindowTotal(sql string) (string, bool) {
+	// DISTINCT在窗口函数之后去重，总数不准确
+	if fields := strings.Fields(strings.ToUpper(sql)); len(fields) > 1 && fields[1] == "DISTINCT" {
+		return "", false
+	}
+	if i := topLevelFrom(sql); i > 0 {
+		return strings.TrimRight(sql[:i], " \t\n") + windowTotalSelect + " " + sql[i:], true
+	}
+	return "", false
+}
+
+// topLevelFrom 最外层FROM关键字的位置，忽略括号及引号内的内容
+func topLevelFrom(sql string) int {
+	depth := 0
+	var quote byte
+	upper := strings.ToUpper(sql)
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(upper[i:], "FROM") &&
+			(i == 0 || isSpace(sql[i-1])) && (i+4 == len(sql) || isSpace(sql[i+4])):
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isStructSlice(dest interface{}) bool {
+	t := reflect.TypeOf(dest)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Slice {
+		return false
+	}
+	t = t.Elem().Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/luoskak/zsql/pkg/schema"
+)
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// coerce 按字段类型转换值，查询串中的值均为字符串
+func coerce(field *schema.Field, value interface{}) (interface{}, error) {
+	switch field.DataType {
+	case schema.Bool:
+		return coerceBool(value)
+	case schema.Int:
+		switch v := value.(type) {
+		case json.Number:
+			return strconv.ParseInt(v.String(), 10, 64)
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		case float64:
+			if v == math.Trunc(v) && v >= math.MinInt64 && v <= math.MaxInt64 {
+				return int64(v), nil
+			}
+		case int, int64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("expected integer, got %v", value)
+	case schema.Uint:
+		switch v := value.(type) {
+		case json.Number:
+			return strconv.ParseUint(v.String(), 10, 64)
+		case string:
+			return strconv.ParseUint(v, 10, 64)
+		case float64:
+			if v == math.Trunc(v) && v >= 0 && v <= math.MaxUint64 {
+				return uint64(v), nil
+			}
+		case uint, uint64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("expected unsigned integer, got %v", value)
+	case schema.Float:
+		switch v := value.(type) {
+		case json.Number:
+			return v.Float64()
+		case string:
+			return strconv.ParseFloat(v, 64)
+		case float64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("expected number, got %v", value)
+	case schema.Time:
+		switch v := value.(type) {
+		case string:
+			for _, layout := range timeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, nil
+				}
+			}
+			return nil, fmt.Errorf("expected time in RFC3339 or 2006-01-02 format, got %q", v)
+		case time.Time:
+			return v, nil
+		}
+		return nil, fmt.Errorf("expected time, got %v", value)
+	default:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			return v.String(), nil
+		}
+		return nil, fmt.Errorf("expected string, got %v", value)
+	}
+}
+
+func coerceBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	case json.Number:
+		return strconv.ParseBool(v.String())
+	}
+	return false, fmt.Errorf("expected boolean, got %v", value)
+}
@@ -0,0 +1,442 @@
+// Package filter 将请求中的过滤条件解析为zsql.WhereColumn，
+// 字段需在模型schema及白名单内，值按字段类型转换，并限制嵌套深度及条件数量。
+//
+// JSON格式与Where的map写法一致，操作符可使用SQL写法或简写：
+//
+//	{"age": {"gte": 3}, "name": {"like": "a%"}, "OR": [{"admin": true}, {"id": [1, 2]}]}
+//
+// 查询串格式为 field[op]=value，如 ?age[gte]=3&name[like]=a%
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/luoskak/zsql"
+	"github.com/luoskak/zsql/pkg/schema"
+)
+
+const (
+	defaultMaxDepth      = 4
+	defaultMaxConditions = 32
+	defaultMaxValues     = 100
+	defaultMaxBytes      = 64 << 10
+)
+
+var (
+	// ErrInvalidFilter 所有解析错误均包装该错误
+	ErrInvalidFilter = errors.New("invalid filter")
+	// ErrNoFields 白名单中没有可用字段
+	ErrNoFields = errors.New("filter has no allowed fields")
+)
+
+// Error 过滤条件错误，Path为出错位置，如 age.gte 或 OR[1].name
+type Error struct {
+	Path   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return "invalid filter: " + e.Reason
+	}
+	return fmt.Sprintf("invalid filter %s: %s", e.Path, e.Reason)
+}
+
+func (e *Error) Unwrap() error {
+	return ErrInvalidFilter
+}
+
+func errorf(path, format string, args ...interface{}) error {
+	return &Error{Path: path, Reason: fmt.Sprintf(format, args...)}
+}
+
+// operators 简写操作符
+var operators = map[string]zsql.WhereEquality{
+	"eq":       zsql.WE_EQ,
+	"ne":       zsql.WE_NE,
+	"gt":       zsql.WE_GT,
+	"gte":      zsql.WE_GTE,
+	"lt":       zsql.WE_LT,
+	"lte":      zsql.WE_LTE,
+	"like":     zsql.WE_LK,
+	"nlike":    zsql.WE_NLK,
+	"ilike":    zsql.WE_ILIKE,
+	"in":       zsql.WE_IN,
+	"nin":      zsql.WE_NIN,
+	"between":  zsql.WE_BETWEEN,
+	"nbetween": zsql.WE_NBETWEEN,
+	"null":     zsql.WE_NULL,
+	"notnull":  zsql.WE_NOTNULL,
+}
+
+func toEquality(op string) zsql.WhereEquality {
+	if equality, ok := operators[strings.ToLower(op)]; ok {
+		return equality
+	}
+	// EXISTS需要子查询，不能来自请求
+	if equality := zsql.ToWhereEquality(op); equality != zsql.WE_EXISTS {
+		return equality
+	}
+	return ""
+}
+
+var defaultCacheStore = &sync.Map{}
+
+type Filter struct {
+	schema        *schema.Schema
+	fields        map[string]*schema.Field
+	allow         []string
+	ignore        map[string]bool
+	namer         schema.Namer
+	cacheStore    *sync.Map
+	maxDepth      int
+	maxConditions int
+	maxValues     int
+	maxBytes      int
+}
+
+type Option func(f *Filter)
+
+// Allow 允许过滤的字段，可使用字段名或列名，必须指定，未列出的字段均不可过滤
+func Allow(fields ...string) Option {
+	return func(f *Filter) {
+		f.allow = append(f.allow, fields...)
+	}
+}
+
+// Ignore 查询串中忽略的参数，如分页参数
+func Ignore(keys ...string) Option {
+	return func(f *Filter) {
+		for _, key := range keys {
+			f.ignore[key] = true
+		}
+	}
+}
+
+// NamingStrategy 列名命名规则，需与zsql.NamingStrategy一致
+func NamingStrategy(namer schema.Namer) Option {
+	return func(f *Filter) {
+		if namer != nil {
+			f.namer = namer
+		}
+	}
+}
+
+// MaxDepth OR/AND最大嵌套层数，默认4
+func MaxDepth(n int) Option {
+	return func(f *Filter) {
+		if n > 0 {
+			f.maxDepth = n
+		}
+	}
+}
+
+// MaxConditions 最大条件数，默认32
+func MaxConditions(n int) Option {
+	return func(f *Filter) {
+		if n > 0 {
+			f.maxConditions = n
+		}
+	}
+}
+
+// MaxValues IN类操作最多的值个数，默认100
+func MaxValues(n int) Option {
+	return func(f *Filter) {
+		if n > 0 {
+			f.maxValues = n
+		}
+	}
+}
+
+// MaxBytes JSON最大长度，默认64KB
+func MaxBytes(n int) Option {
+	return func(f *Filter) {
+		if n > 0 {
+			f.maxBytes = n
+		}
+	}
+}
+
+// New 根据模型创建Filter，可在多个请求间复用
+func New(model interface{}, opts ...Option) (*Filter, error) {
+	f := &Filter{
+		fields:        map[string]*schema.Field{},
+		ignore:        map[string]bool{},
+		namer:         schema.NamingStrategy{},
+		cacheStore:    defaultCacheStore,
+		maxDepth:      defaultMaxDepth,
+		maxConditions: defaultMaxConditions,
+		maxValues:     defaultMaxValues,
+		maxBytes:      defaultMaxBytes,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	sc, err := schema.Parse(model, f.cacheStore, f.namer)
+	if err != nil {
+		return nil, err
+	}
+	f.schema = sc
+	for _, name := range f.allow {
+		field := sc.LookUpField(name)
+		if field == nil || field.DBName == "" {
+			return nil, fmt.Errorf("filter: unknown field %s of %s", name, sc.Name)
+		}
+		f.fields[field.DBName] = field
+	}
+	if len(f.fields) == 0 {
+		return nil, ErrNoFields
+	}
+	// 字段名同样可用
+	for _, field := range f.fields {
+		if _, ok := f.fields[field.Name]; !ok {
+			f.fields[field.Name] = field
+		}
+	}
+	return f, nil
+}
+
+// ParseJSON 解析JSON过滤条件，空内容返回nil
+func (f *Filter) ParseJSON(data []byte) (zsql.WhereColumn, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	if len(data) > f.maxBytes {
+		return nil, errorf("", "exceeds %d bytes", f.maxBytes)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var m map[string]interface{}
+	if err := decoder.Decode(&m); err != nil {
+		return nil, &Error{Reason: err.Error()}
+	}
+	return f.Parse(m)
+}
+
+// Parse 解析已解码的过滤条件，条件之间以AND连接，没有条件时返回nil
+func (f *Filter) Parse(m map[string]interface{}) (zsql.WhereColumn, error) {
+	p := &parser{Filter: f}
+	columns, err := p.group("", m, 1)
+	if err != nil {
+		return nil, err
+	}
+	return group(columns), nil
+}
+
+func group(columns []zsql.WhereColumn) zsql.WhereColumn {
+	switch len(columns) {
+	case 0:
+		return nil
+	case 1:
+		return columns[0]
+	default:
+		return zsql.AndGroup(columns...)
+	}
+}
+
+type parser struct {
+	*Filter
+	conditions int
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// group 解析一组以AND连接的条件
+func (p *parser) group(path string, m map[string]interface{}, depth int) ([]zsql.WhereColumn, error) {
+	if depth > p.maxDepth {
+		return nil, errorf(path, "exceeds max depth %d", p.maxDepth)
+	}
+	var columns []zsql.WhereColumn
+	for _, key := range sortedKeys(m) {
+		value := m[key]
+		if logic := strings.ToUpper(key); logic == "OR" || logic == "AND" {
+			column, err := p.logic(join(path, key), logic, value, depth)
+			if err != nil {
+				return nil, err
+			}
+			if column != nil {
+				columns = append(columns, column)
+			}
+			continue
+		}
+		field, ok := p.fields[key]
+		if !ok {
+			return nil, errorf(join(path, key), "unknown field")
+		}
+		cs, err := p.field(join(path, key), field, value, depth)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, cs...)
+	}
+	return columns, nil
+}
+
+// logic OR/AND的值为对象时其中各条件之间以OR/AND连接，
+// 为数组时各元素之间以OR/AND连接，结果整体与同级条件以AND连接
+func (p *parser) logic(path, logic string, value interface{}, depth int) (zsql.WhereColumn, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		columns, err := p.group(path, v, depth+1)
+		if err != nil || len(columns) == 0 {
+			return nil, err
+		}
+		if logic == "OR" {
+			items := make([]zsql.WhereColumn, len(columns))
+			for i, column := range columns {
+				items[i] = zsql.OrGroup(column)
+			}
+			return zsql.AndGroup(items...), nil
+		}
+		return zsql.AndGroup(columns...), nil
+	case []interface{}:
+		var items []zsql.WhereColumn
+		for i, item := range v {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errorf(fmt.Sprintf("%s[%d]", path, i), "must be an object")
+			}
+			columns, err := p.group(fmt.Sprintf("%s[%d]", path, i), m, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if len(columns) == 0 {
+				continue
+			}
+			if logic == "OR" {
+				items = append(items, zsql.OrGroup(columns...))
+			} else {
+				items = append(items, zsql.AndGroup(columns...))
+			}
+		}
+		if len(items) == 0 {
+			return nil, nil
+		}
+		return zsql.AndGroup(items...), nil
+	default:
+		return nil, errorf(path, "must be an object or an array of objects")
+	}
+}
+
+// field 值为对象时为 操作符:值，否则数组为IN，其他为相等
+func (p *parser) field(path string, field *schema.Field, value interface{}, depth int) ([]zsql.WhereColumn, error) {
+	ops, ok := value.(map[string]interface{})
+	if !ok {
+		equality := zsql.WE_EQ
+		if _, is := value.([]interface{}); is {
+			equality = zsql.WE_IN
+		}
+		column, err := p.condition(path, field, equality, value)
+		if err != nil {
+			return nil, err
+		}
+		return []zsql.WhereColumn{column}, nil
+	}
+	var columns []zsql.WhereColumn
+	for _, op := range sortedKeys(ops) {
+		if logic := strings.ToUpper(op); logic == "OR" || logic == "AND" {
+			column, err := p.logic(join(path, op), logic, ops[op], depth)
+			if err != nil {
+				return nil, err
+			}
+			if column != nil {
+				columns = append(columns, column)
+			}
+			continue
+		}
+		equality := toEquality(op)
+		if equality == "" {
+			return nil, errorf(join(path, op), "unsupported operator")
+		}
+		column, err := p.condition(join(path, op), field, equality, ops[op])
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func (p *parser) condition(path string, field *schema.Field, equality zsql.WhereEquality, value interface{}) (zsql.WhereColumn, error) {
+	p.conditions++
+	if p.conditions > p.maxConditions {
+		return nil, errorf(path, "exceeds max %d conditions", p.maxConditions)
+	}
+	switch equality {
+	case zsql.WE_NULL, zsql.WE_NOTNULL:
+		// {"null": true} / {"null": false}
+		is := true
+		if value != nil {
+			b, err := coerceBool(value)
+			if err != nil {
+				return nil, errorf(path, "%v", err)
+			}
+			is = b
+		}
+		if is != (equality == zsql.WE_NULL) {
+			equality = zsql.WE_NOTNULL
+		} else {
+			equality = zsql.WE_NULL
+		}
+		return zsql.And(field.DBName, equality, nil), nil
+	case zsql.WE_IN, zsql.WE_NIN, zsql.WE_BETWEEN, zsql.WE_NBETWEEN:
+		vs, ok := value.([]interface{})
+		if !ok {
+			return nil, errorf(path, "must be an array")
+		}
+		if len(vs) == 0 {
+			return nil, errorf(path, "must not be empty")
+		}
+		if len(vs) > p.maxValues {
+			return nil, errorf(path, "exceeds max %d values", p.maxValues)
+		}
+		if (equality == zsql.WE_BETWEEN || equality == zsql.WE_NBETWEEN) && len(vs) != 2 {
+			return nil, errorf(path, "must have exactly 2 values")
+		}
+		values := make([]interface{}, len(vs))
+		for i, v := range vs {
+			cv, err := coerce(field, v)
+			if err != nil {
+				return nil, errorf(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+			}
+			values[i] = cv
+		}
+		return zsql.And(field.DBName, equality, values), nil
+	case zsql.WE_LK, zsql.WE_NLK, zsql.WE_ILIKE:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errorf(path, "must be a string")
+		}
+		return zsql.And(field.DBName, equality, s), nil
+	default:
+		if value == nil {
+			return nil, errorf(path, "must not be null")
+		}
+		cv, err := coerce(field, value)
+		if err != nil {
+			return nil, errorf(path, "%v", err)
+		}
+		return zsql.And(field.DBName, equality, cv), nil
+	}
+}
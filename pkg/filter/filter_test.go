@@ -0,0 +1,158 @@
+package filter
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luoskak/zsql"
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	ID        int64
+	Name      string
+	Age       uint8
+	Score     float64
+	Admin     bool
+	Password  string
+	CreatedAt time.Time
+}
+
+type testBuilder struct {
+	strings.Builder
+	vals []interface{}
+}
+
+func (b *testBuilder) WriteQuoted(field interface{}) {
+	b.WriteString(field.(string))
+}
+
+func (b *testBuilder) AddVar(vars ...interface{}) {
+	b.vals = append(b.vals, vars...)
+}
+
+func (b *testBuilder) AddFieldVar(field string, vars ...interface{}) {
+	b.AddVar(vars...)
+}
+
+func build(column zsql.WhereColumn) (string, []interface{}) {
+	b := &testBuilder{}
+	zsql.Where{Columns: []zsql.WhereColumn{column}}.Build(b)
+	return b.String(), b.vals
+}
+
+func TestParseJSON(t *testing.T) {
+	f, err := New(&user{}, Allow("id", "name", "Age", "admin", "created_at"))
+	assert.Nil(t, err)
+
+	column, err := f.ParseJSON([]byte(`{"age": {"gte": 3, "<": "60"}, "name": {"like": "a%"}, "id": [1, 2]}`))
+	assert.Nil(t, err)
+	sql, vals := build(column)
+	assert.Equal(t, "age < ? AND age >= ? AND id IN(?,?) AND name LIKE ?", sql)
+	assert.Equal(t, []interface{}{uint64(60), uint64(3), int64(1), int64(2), "a%"}, vals)
+
+	column, err = f.ParseJSON([]byte(`{"admin": true, "OR": [{"id": 1}, {"name": {"null": true}}]}`))
+	assert.Nil(t, err)
+	sql, vals = build(column)
+	assert.Equal(t, "(id = ? OR name IS NULL) AND admin = ?", sql)
+	assert.Equal(t, []interface{}{int64(1), true}, vals)
+
+	column, err = f.ParseJSON([]byte(`{"created_at": {"between": ["2024-01-01", "2024-02-01T00:00:00Z"]}}`))
+	assert.Nil(t, err)
+	_, vals = build(column)
+	assert.Equal(t, []interface{}{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}, vals)
+
+	column, err = f.ParseJSON(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, column)
+}
+
+func TestParseErrors(t *testing.T) {
+	f, err := New(&user{}, Allow("id", "name", "age"), MaxDepth(2), MaxConditions(3), MaxValues(2))
+	assert.Nil(t, err)
+
+	cases := map[string]string{
+		`{"password": "x"}`:                                 "invalid filter password: unknown field",
+		`{"age": {"regexp": 1}}`:                            "invalid filter age.regexp: unsupported operator",
+		`{"age": {"exists": 1}}`:                            "invalid filter age.exists: unsupported operator",
+		`{"age": "abc"}`:                                    `invalid filter age: strconv.ParseUint: parsing "abc": invalid syntax`,
+		`{"id": 1.5}`:                                       `invalid filter id: strconv.ParseInt: parsing "1.5": invalid syntax`,
+		`{"name": {"like": 1}}`:                             "invalid filter name.like: must be a string",
+		`{"id": {"in": [1, 2, 3]}}`:                         "invalid filter id.in: exceeds max 2 values",
+		`{"id": {"between": [1]}}`:                          "invalid filter id.between: must have exactly 2 values",
+		`{"id": {"in": [1, "x"]}}`:                          `invalid filter id.in[1]: strconv.ParseInt: parsing "x": invalid syntax`,
+		`{"id": 1, "age": 2, "name": "a", "OR": {"id": 2}}`: "invalid filter name: exceeds max 3 conditions",
+		`{"OR": {"AND": {"id": 1}}}`:                        "invalid filter OR.AND: exceeds max depth 2",
+		`{"OR": [1]}`:                                       "invalid filter OR[0]: must be an object",
+	}
+	for body, msg := range cases {
+		_, err := f.ParseJSON([]byte(body))
+		if assert.NotNil(t, err, body) {
+			assert.Equal(t, msg, err.Error(), body)
+			assert.True(t, errors.Is(err, ErrInvalidFilter))
+		}
+	}
+
+	_, err = New(&user{}, Allow("missing"))
+	assert.NotNil(t, err)
+}
+
+func TestAllowRequired(t *testing.T) {
+	_, err := New(&user{})
+	assert.True(t, errors.Is(err, ErrNoFields))
+
+	f, err := New(&user{}, Allow("id"))
+	assert.Nil(t, err)
+	_, err = f.ParseJSON([]byte(`{"password": "x"}`))
+	assert.EqualError(t, err, "invalid filter password: unknown field")
+	_, err = f.ParseQuery(url.Values{"password": {"x"}})
+	assert.EqualError(t, err, "invalid filter password: unknown field")
+}
+
+func TestParseLogicObject(t *testing.T) {
+	f, err := New(&user{}, Allow("id", "name", "admin"))
+	assert.Nil(t, err)
+
+	// 单独的OR对象与之前的条件以AND连接，不能扩大查询范围
+	column, err := f.ParseJSON([]byte(`{"OR": {"id": 1, "name": "a"}}`))
+	assert.Nil(t, err)
+	b := &testBuilder{}
+	zsql.Where{Columns: []zsql.WhereColumn{zsql.And("tenant_id", "=", 7), column}}.Build(b)
+	assert.Equal(t, "tenant_id = ? AND (id = ? OR name = ?)", b.String())
+	assert.Equal(t, []interface{}{7, int64(1), "a"}, b.vals)
+	sql, _ := build(column)
+	assert.Equal(t, "id = ? OR name = ?", sql)
+
+	column, err = f.ParseJSON([]byte(`{"admin": false, "OR": {"id": 1, "name": "a"}}`))
+	assert.Nil(t, err)
+	sql, vals := build(column)
+	assert.Equal(t, "(id = ? OR name = ?) AND admin = ?", sql)
+	assert.Equal(t, []interface{}{int64(1), "a", false}, vals)
+
+	column, err = f.ParseJSON([]byte(`{"admin": true, "AND": {"id": 1, "name": "a"}}`))
+	assert.Nil(t, err)
+	sql, _ = build(column)
+	assert.Equal(t, "(id = ? AND name = ?) AND admin = ?", sql)
+}
+
+func TestParseQuery(t *testing.T) {
+	f, err := New(&user{}, Allow("id", "age", "name", "admin", "score"), Ignore("page"))
+	assert.Nil(t, err)
+
+	values, _ := url.ParseQuery("age[gte]=3&name[like]=a%25&id[in]=1,2&id[in]=3&admin=true&score[null]=false&page=2")
+	column, err := f.ParseQuery(values)
+	assert.Nil(t, err)
+	sql, vals := build(column)
+	assert.Equal(t, "admin = ? AND age >= ? AND id IN(?,?,?) AND name LIKE ? AND score IS NOT NULL", sql)
+	assert.Equal(t, []interface{}{true, uint64(3), int64(1), int64(2), int64(3), "a%"}, vals)
+
+	_, err = f.ParseQuery(url.Values{"age[gte": {"3"}})
+	assert.EqualError(t, err, "invalid filter age[gte: malformed parameter")
+	_, err = f.ParseQuery(url.Values{"age": {"1", "2"}})
+	assert.EqualError(t, err, "invalid filter age: must have a single value")
+	_, err = f.ParseQuery(url.Values{"unknown[eq]": {"1"}})
+	assert.EqualError(t, err, "invalid filter unknown: unknown field")
+}
@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/luoskak/zsql"
+)
+
+// queryKeyExp field 或 field[op]
+var queryKeyExp = regexp.MustCompile(`^([^\[\]]+)(?:\[([a-zA-Z_ ]+)\])?$`)
+
+// ParseQuery 解析查询串过滤条件，条件之间以AND连接，
+// in/nin/between的值以逗号分隔或重复参数，如 id[in]=1,2&id[in]=3
+func (f *Filter) ParseQuery(values url.Values) (zsql.WhereColumn, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	p := &parser{Filter: f}
+	var columns []zsql.WhereColumn
+	for _, key := range keys {
+		if f.ignore[key] {
+			continue
+		}
+		match := queryKeyExp.FindStringSubmatch(key)
+		if match == nil {
+			return nil, errorf(key, "malformed parameter")
+		}
+		field, ok := f.fields[match[1]]
+		if !ok {
+			return nil, errorf(match[1], "unknown field")
+		}
+		equality := zsql.WE_EQ
+		if match[2] != "" {
+			if equality = toEquality(match[2]); equality == "" {
+				return nil, errorf(join(match[1], match[2]), "unsupported operator")
+			}
+		}
+		path := key
+		var value interface{}
+		switch equality {
+		case zsql.WE_IN, zsql.WE_NIN, zsql.WE_BETWEEN, zsql.WE_NBETWEEN:
+			var vs []interface{}
+			for _, v := range values[key] {
+				for _, item := range strings.Split(v, ",") {
+					vs = append(vs, item)
+				}
+			}
+			value = vs
+		case zsql.WE_NULL, zsql.WE_NOTNULL:
+			// name[null] 或 name[null]=false
+			if v := values.Get(key); v != "" {
+				value = v
+			}
+		default:
+			if len(values[key]) > 1 {
+				return nil, errorf(path, "must have a single value")
+			}
+			value = values.Get(key)
+		}
+		column, err := p.condition(path, field, equality, value)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return group(columns), nil
+}
@@ -0,0 +1,65 @@
+// Package otelzsql adapts an OpenTelemetry tracer to zsql.Tracer
+package otelzsql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/luoskak/zsql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	_ zsql.Tracer        = tracer{}
+	_ zsql.TraceParenter = span{}
+)
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer 使用 otel.Tracer("zsql") 等获得的tracer
+func NewTracer(t trace.Tracer) zsql.Tracer {
+	return tracer{tracer: t}
+}
+
+func (t tracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, zsql.Span) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]attribute.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		if attrs[k] != "" {
+			kvs = append(kvs, attribute.String(k, attrs[k]))
+		}
+	}
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(kvs...))
+	return ctx, span{span: s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.span.End()
+}
+
+// TraceParent w3c traceparent: version-traceid-spanid-flags
+func (s span) TraceParent() string {
+	sc := s.span.SpanContext()
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags())
+}
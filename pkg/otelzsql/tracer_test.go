@@ -0,0 +1,100 @@
+package otelzsql
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/luoskak/zsql"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpan 在noop span之上记录调用
+type recordSpan struct {
+	trace.Span
+	name   string
+	config trace.SpanConfig
+	errs   []error
+	code   codes.Code
+	desc   string
+	ended  bool
+}
+
+func (s *recordSpan) RecordError(err error, options ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordSpan) SetStatus(code codes.Code, description string) {
+	s.code = code
+	s.desc = description
+}
+
+func (s *recordSpan) End(options ...trace.SpanEndOption) {
+	s.ended = true
+}
+
+// recordTracer 使用给定的SpanContext开始span
+type recordTracer struct {
+	sc    trace.SpanContext
+	spans []*recordSpan
+}
+
+func (t *recordTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	s := &recordSpan{
+		Span:   trace.SpanFromContext(trace.ContextWithSpanContext(ctx, t.sc)),
+		name:   name,
+		config: trace.NewSpanStartConfig(opts...),
+	}
+	t.spans = append(t.spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func TestTracer(t *testing.T) {
+	rt := &recordTracer{}
+	tr := NewTracer(rt)
+
+	ctx, span := tr.Start(context.Background(), "zsql.select", map[string]string{
+		zsql.AttrDBSystem:    "postgres",
+		zsql.AttrDBName:      "default",
+		zsql.AttrDBTable:     "",
+		zsql.AttrDBStatement: "SELECT 1",
+	})
+	assert.Equal(t, 1, len(rt.spans))
+	s := rt.spans[0]
+	assert.Equal(t, s, trace.SpanFromContext(ctx))
+	assert.Equal(t, "zsql.select", s.name)
+	assert.Equal(t, trace.SpanKindClient, s.config.SpanKind())
+	// 按key排序，忽略空值
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String(zsql.AttrDBName, "default"),
+		attribute.String(zsql.AttrDBStatement, "SELECT 1"),
+		attribute.String(zsql.AttrDBSystem, "postgres"),
+	}, s.config.Attributes())
+
+	boom := errors.New("boom")
+	span.RecordError(boom)
+	span.End()
+	assert.Equal(t, []error{boom}, s.errs)
+	assert.Equal(t, codes.Error, s.code)
+	assert.Equal(t, "boom", s.desc)
+	assert.True(t, s.ended)
+}
+
+func TestTraceParent(t *testing.T) {
+	rt := &recordTracer{}
+	_, span := NewTracer(rt).Start(context.Background(), "zsql.select", nil)
+	assert.Equal(t, "", span.(zsql.TraceParenter).TraceParent())
+
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	rt.sc = trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+	_, span = NewTracer(rt).Start(context.Background(), "zsql.select", nil)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", span.(zsql.TraceParenter).TraceParent())
+
+	rt.sc = rt.sc.WithTraceFlags(0)
+	_, span = NewTracer(rt).Start(context.Background(), "zsql.select", nil)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", span.(zsql.TraceParenter).TraceParent())
+}
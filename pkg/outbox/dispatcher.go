@@ -0,0 +1,195 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/luoskak/logger"
+	"github.com/luoskak/zsql"
+)
+
+const (
+	defaultBatchSize  = 100
+	defaultInterval   = time.Second
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 10 * time.Minute
+	defaultLease      = time.Minute
+	maxErrorLength    = 1024
+)
+
+// Sink 投递事件，返回错误时按退避重试
+type Sink interface {
+	Deliver(ctx context.Context, msg Message) error
+}
+
+// SinkFunc func adapter of Sink
+type SinkFunc func(ctx context.Context, msg Message) error
+
+func (f SinkFunc) Deliver(ctx context.Context, msg Message) error {
+	return f(ctx, msg)
+}
+
+// Dispatcher 使用 FOR UPDATE SKIP LOCKED 认领事件，多实例可同时运行
+type Dispatcher struct {
+	db         *zsql.DB
+	outbox     *Outbox
+	sink       Sink
+	batchSize  int
+	interval   time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	lease      time.Duration
+	log        *logger.Logger
+}
+
+type DispatcherOption func(d *Dispatcher)
+
+// BatchSize 每次认领的事件数，默认100
+func BatchSize(size int) DispatcherOption {
+	return func(d *Dispatcher) {
+		if size > 0 {
+			d.batchSize = size
+		}
+	}
+}
+
+// Interval 没有待投递事件时的轮询间隔，默认1s
+func Interval(interval time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		if interval > 0 {
+			d.interval = interval
+		}
+	}
+}
+
+// Backoff 投递失败的重试间隔，按失败次数指数增长，默认1s到10m
+func Backoff(min, max time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		if min > 0 && max >= min {
+			d.minBackoff = min
+			d.maxBackoff = max
+		}
+	}
+}
+
+// Lease 认领后在该时长内不会被再次认领，需大于一批事件的投递耗时，默认1m。
+// 投递过程中进程退出时，事件在lease到期后重新投递
+func Lease(lease time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		if lease > 0 {
+			d.lease = lease
+		}
+	}
+}
+
+// Dispatcher Postgres及MySQL 8支持SKIP LOCKED
+func (o *Outbox) Dispatcher(db *zsql.DB, sink Sink, opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		db:         db,
+		outbox:     o,
+		sink:       sink,
+		batchSize:  defaultBatchSize,
+		interval:   defaultInterval,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		lease:      defaultLease,
+		log:        logger.NewLogger("Outbox:%s", o.table),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Run 持续投递直到ctx结束
+func (d *Dispatcher) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		n, err := d.DispatchOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.log.Error("dispatch failed: %v", err)
+		}
+		// 认领满一批说明可能还有积压，立即继续
+		if err == nil && n == d.batchSize {
+			timer.Reset(0)
+		} else {
+			timer.Reset(d.interval)
+		}
+	}
+}
+
+// DispatchOnce 认领一批到期事件并投递，返回认领数量。
+// 认领事务只将事件的next_attempt_at推迟lease后即提交，投递及结果写入在事务之外，
+// Sink较慢时不会长时间持有行锁
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	msgs, err := d.claim(ctx)
+	if err != nil || len(msgs) == 0 {
+		return len(msgs), err
+	}
+	var delivered []interface{}
+	for _, msg := range msgs {
+		if err := d.sink.Deliver(ctx, msg); err != nil {
+			if err := d.retry(ctx, msg, err); err != nil {
+				return len(msgs), err
+			}
+			continue
+		}
+		delivered = append(delivered, msg.ID)
+	}
+	if len(delivered) == 0 {
+		return len(msgs), nil
+	}
+	args := append([]interface{}{time.Now()}, delivered...)
+	tx := d.db.WithContext(ctx)
+	return len(msgs), tx.Exec(tx.Rebind("UPDATE "+d.outbox.table+" SET delivered_at = ? WHERE id IN ("+placeholders(len(delivered))+")"), args...).Error
+}
+
+// claim 锁定一批到期事件并推迟其next_attempt_at，其他Dispatcher在lease内不会认领
+func (d *Dispatcher) claim(ctx context.Context) ([]Message, error) {
+	var msgs []Message
+	err := d.db.Transaction(ctx, func(tx *zsql.DB) error {
+		now := time.Now()
+		tx.Query(tx.Rebind("SELECT id, topic, payload, attempts, created_at FROM "+d.outbox.table+
+			" WHERE delivered_at IS NULL AND next_attempt_at <= ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED"), now, d.batchSize).Find(&msgs)
+		if tx.Error != nil || len(msgs) == 0 {
+			return tx.Error
+		}
+		args := []interface{}{now.Add(d.lease)}
+		for _, msg := range msgs {
+			args = append(args, msg.ID)
+		}
+		return tx.Exec(tx.Rebind("UPDATE "+d.outbox.table+" SET next_attempt_at = ? WHERE id IN ("+placeholders(len(msgs))+")"), args...).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (d *Dispatcher) retry(ctx context.Context, msg Message, cause error) error {
+	attempts := msg.Attempts + 1
+	lastError := cause.Error()
+	if len(lastError) > maxErrorLength {
+		lastError = lastError[:maxErrorLength]
+	}
+	next := time.Now().Add(d.backoff(attempts))
+	tx := d.db.WithContext(ctx)
+	return tx.Exec(tx.Rebind("UPDATE "+d.outbox.table+" SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?"), attempts, lastError, next, msg.ID).Error
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.minBackoff
+	for i := 1; i < attempts && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxBackoff {
+		backoff = d.maxBackoff
+	}
+	return backoff
+}
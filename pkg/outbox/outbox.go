@@ -0,0 +1,117 @@
+// Package outbox 事务性发件箱，事件与业务数据在同一事务中写入，
+// 由Dispatcher至少投递一次
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/luoskak/zsql"
+)
+
+const defaultTable = "zsql_outbox"
+
+var ErrTopicEmpty = errors.New("outbox topic can not be empty")
+
+// Message 发件箱中的一条事件
+type Message struct {
+	ID        int64
+	Topic     string
+	Payload   string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+type Outbox struct {
+	table string
+}
+
+type Option func(o *Outbox)
+
+// Table 发件箱表名，默认zsql_outbox
+func Table(table string) Option {
+	return func(o *Outbox) {
+		if table != "" {
+			o.table = table
+		}
+	}
+}
+
+func New(opts ...Option) *Outbox {
+	o := &Outbox{table: defaultTable}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Install 创建发件箱表
+func (o *Outbox) Install(ctx context.Context, db *zsql.DB) error {
+	var ddl []string
+	switch db.Dialect() {
+	case "mysql":
+		ddl = []string{
+			"CREATE TABLE IF NOT EXISTS " + o.table + " (" +
+				"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+				"topic VARCHAR(255) NOT NULL, " +
+				"payload LONGTEXT NOT NULL, " +
+				"attempts INT NOT NULL DEFAULT 0, " +
+				"last_error TEXT NULL, " +
+				"next_attempt_at DATETIME(6) NOT NULL, " +
+				"delivered_at DATETIME(6) NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"INDEX idx_" + o.table + "_pending (delivered_at, next_attempt_at))",
+		}
+	default:
+		ddl = []string{
+			"CREATE TABLE IF NOT EXISTS " + o.table + " (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"topic VARCHAR(255) NOT NULL, " +
+				"payload TEXT NOT NULL, " +
+				"attempts INT NOT NULL DEFAULT 0, " +
+				"last_error TEXT NULL, " +
+				"next_attempt_at TIMESTAMPTZ NOT NULL, " +
+				"delivered_at TIMESTAMPTZ NULL, " +
+				"created_at TIMESTAMPTZ NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS idx_" + o.table + "_pending ON " + o.table + " (next_attempt_at) WHERE delivered_at IS NULL",
+		}
+	}
+	return db.Transaction(ctx, func(tx *zsql.DB) error {
+		for _, statement := range ddl {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Add 在tx中写入事件，payload为string、[]byte或可JSON序列化的值；
+// tx回滚则事件一并丢弃
+func (o *Outbox) Add(tx *zsql.DB, topic string, payload interface{}) error {
+	if topic == "" {
+		return ErrTopicEmpty
+	}
+	var data string
+	switch v := payload.(type) {
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	now := time.Now()
+	return tx.Exec(tx.Rebind("INSERT INTO "+o.table+" (topic, payload, attempts, next_attempt_at, created_at) VALUES (?, ?, 0, ?, ?)"), topic, data, now, now).Error
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
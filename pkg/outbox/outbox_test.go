@@ -0,0 +1,141 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luoskak/mist"
+	"github.com/luoskak/zsql"
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDB(handler fakedb.Handler) (*zsql.DB, *fakedb.Source) {
+	source := fakedb.New(handler)
+	mw := &zsql.Middleware{}
+	mw.Init([]mist.Option{zsql.MysqlAddress("", source.DSN(), source.DSN()+"?"), zsql.Log(zsql.LogSilent)})
+	var db *zsql.DB
+	mw.Inter(false)(context.Background(), nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		db = zsql.Get(ctx)
+		return nil, nil
+	})
+	return db, source
+}
+
+// pending 认领查询返回的事件
+func pending(ids ...int64) fakedb.Handler {
+	return func(sql string, args []interface{}) fakedb.Result {
+		if !strings.HasPrefix(sql, "SELECT") {
+			return fakedb.Result{RowsAffected: 1}
+		}
+		r := fakedb.Result{Columns: []string{"id", "topic", "payload", "attempts", "created_at"}}
+		for _, id := range ids {
+			r.Rows = append(r.Rows, []interface{}{id, "user.created", `{"id":1}`, int64(2), time.Now()})
+		}
+		return r
+	}
+}
+
+func TestAdd(t *testing.T) {
+	db, source := newDB(nil)
+	o := New(Table("events"))
+	assert.Nil(t, o.Add(db, "user.created", map[string]int{"id": 1}))
+	assert.ErrorIs(t, o.Add(db, "", "x"), ErrTopicEmpty)
+
+	calls := source.Calls()
+	assert.Equal(t, 1, len(calls))
+	assert.Equal(t, "INSERT INTO events (topic, payload, attempts, next_attempt_at, created_at) VALUES (?, ?, 0, ?, ?)", calls[0].SQL)
+	assert.Equal(t, []interface{}{"user.created", `{"id":1}`}, calls[0].Args[:2])
+}
+
+func TestDispatchDeliversOutsideClaim(t *testing.T) {
+	db, source := newDB(pending(1, 2))
+	var (
+		delivered []int64
+		committed []bool
+	)
+	sink := SinkFunc(func(ctx context.Context, msg Message) error {
+		sqls := source.SQL()
+		committed = append(committed, sqls[len(sqls)-1] == fakedb.Commit)
+		delivered = append(delivered, msg.ID)
+		assert.Equal(t, 2, msg.Attempts)
+		return nil
+	})
+	n, err := New().Dispatcher(db, sink, BatchSize(10), Lease(time.Hour)).DispatchOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int64{1, 2}, delivered)
+	// 投递时认领事务已提交
+	assert.Equal(t, []bool{true, true}, committed)
+
+	calls := source.Calls()
+	assert.Equal(t, []string{
+		fakedb.Begin,
+		"SELECT id, topic, payload, attempts, created_at FROM zsql_outbox WHERE delivered_at IS NULL AND next_attempt_at <= ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+		"UPDATE zsql_outbox SET next_attempt_at = ? WHERE id IN (?,?)",
+		fakedb.Commit,
+		"UPDATE zsql_outbox SET delivered_at = ? WHERE id IN (?,?)",
+	}, source.SQL())
+	assert.Equal(t, int64(10), calls[1].Args[1])
+	lease := calls[2].Args[0].(time.Time)
+	assert.True(t, lease.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, []interface{}{int64(1), int64(2)}, calls[2].Args[1:])
+	assert.Equal(t, []interface{}{int64(1), int64(2)}, calls[4].Args[1:])
+}
+
+func TestDispatchRetry(t *testing.T) {
+	db, source := newDB(pending(1, 2))
+	sink := SinkFunc(func(ctx context.Context, msg Message) error {
+		if msg.ID == 2 {
+			return errors.New("broker unavailable")
+		}
+		return nil
+	})
+	d := New().Dispatcher(db, sink, Backoff(time.Second, time.Minute))
+	n, err := d.DispatchOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	calls := source.Calls()
+	assert.Equal(t, 6, len(calls))
+	retry := calls[4]
+	assert.Equal(t, "UPDATE zsql_outbox SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?", retry.SQL)
+	assert.Equal(t, int64(3), retry.Args[0])
+	assert.Equal(t, "broker unavailable", retry.Args[1])
+	next := retry.Args[2].(time.Time)
+	assert.True(t, next.After(time.Now().Add(3*time.Second)) && next.Before(time.Now().Add(5*time.Second)))
+	assert.Equal(t, int64(2), retry.Args[3])
+	assert.Equal(t, "UPDATE zsql_outbox SET delivered_at = ? WHERE id IN (?)", calls[5].SQL)
+	assert.Equal(t, int64(1), calls[5].Args[1])
+
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 8*time.Second, d.backoff(4))
+	assert.Equal(t, time.Minute, d.backoff(20))
+}
+
+func TestDispatchNothingClaimed(t *testing.T) {
+	db, source := newDB(pending())
+	n, err := New().Dispatcher(db, SinkFunc(func(ctx context.Context, msg Message) error {
+		t.Fatal("nothing to deliver")
+		return nil
+	})).DispatchOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 3, len(source.Calls()))
+}
+
+func TestDispatchClaimError(t *testing.T) {
+	db, source := newDB(func(sql string, args []interface{}) fakedb.Result {
+		if strings.HasPrefix(sql, "SELECT") {
+			return fakedb.Result{Err: errors.New("lock wait timeout")}
+		}
+		return fakedb.Result{}
+	})
+	_, err := New().Dispatcher(db, SinkFunc(func(ctx context.Context, msg Message) error { return nil })).DispatchOnce(context.Background())
+	assert.EqualError(t, err, "lock wait timeout")
+	sqls := source.SQL()
+	assert.Equal(t, fakedb.Rollback, sqls[len(sqls)-1])
+}
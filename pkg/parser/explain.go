@@ -1,7 +1,9 @@
 package parser
 
 import (
+	"crypto/sha256"
 	"database/sql/driver"
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"regexp"
@@ -38,6 +40,8 @@ func ExplainSQL(sql string, numericPlaceholder *regexp.Regexp, escaper string, a
 
 	convertParams = func(v interface{}, idx int) {
 		switch v := v.(type) {
+		case Masked:
+			vars[idx] = escaper + string(v) + escaper
 		case bool:
 			vars[idx] = strconv.FormatBool(v)
 		case time.Time:
@@ -133,3 +137,49 @@ func ExplainSQL(sql string, numericPlaceholder *regexp.Regexp, escaper string, a
 
 	return sql
 }
+
+// Redactor 决定日志中的参数是否需要脱敏，column为参数对应的列名，未知时为空
+type Redactor interface {
+	Redact(column string, value interface{}) (replacement string, redact bool)
+}
+
+// RedactorFunc func adapter of Redactor
+type RedactorFunc func(column string, value interface{}) (string, bool)
+
+func (f RedactorFunc) Redact(column string, value interface{}) (string, bool) {
+	return f(column, value)
+}
+
+// Masked 已脱敏的参数，ExplainSQL原样输出不再转换
+type Masked string
+
+// Mask replaces value with ***
+func Mask(value interface{}) string {
+	return "***"
+}
+
+// Hash replaces value with a short sha256 digest, same values keep the same digest
+func Hash(value interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Redact 返回脱敏后的参数，columns与vars按下标对应
+func Redact(redactor Redactor, columns []string, vars []interface{}) []interface{} {
+	if redactor == nil {
+		return vars
+	}
+	redacted := make([]interface{}, len(vars))
+	for idx, v := range vars {
+		column := ""
+		if idx < len(columns) {
+			column = columns[idx]
+		}
+		if replacement, ok := redactor.Redact(column, v); ok {
+			redacted[idx] = Masked(replacement)
+		} else {
+			redacted[idx] = v
+		}
+	}
+	return redacted
+}
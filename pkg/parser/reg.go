@@ -1,7 +1,26 @@
 package parser
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+)
 
 var (
 	SqlTypeExp = regexp.MustCompile(`(SELECT)|(UPDATE)|(INSERT)`)
+	// OperationExp 匹配语句开头的关键字，忽略前置注释
+	OperationExp = regexp.MustCompile(`(?is)^\s*(?:/\*.*?\*/\s*)*([a-z]+)`)
 )
+
+// Operation returns the lower case operation of sql,
+// one of select, insert, update, delete or raw
+func Operation(sql string) string {
+	matches := OperationExp.FindStringSubmatch(sql)
+	if len(matches) < 2 {
+		return "raw"
+	}
+	switch op := strings.ToLower(matches[1]); op {
+	case "select", "insert", "update", "delete":
+		return op
+	}
+	return "raw"
+}
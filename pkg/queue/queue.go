@@ -0,0 +1,204 @@
+// Package queue 基于数据库的任务队列，支持mysql 8及postgres。
+// 任务以 FOR UPDATE SKIP LOCKED 认领，认领后在可见性超时内不会被其他worker获取，
+// 失败按退避重试，超过最大次数后标记为dead
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/luoskak/zsql"
+)
+
+const (
+	defaultTable       = "zsql_jobs"
+	defaultMaxAttempts = 25
+
+	statusPending = "pending"
+	statusDead    = "dead"
+)
+
+var (
+	ErrQueueNameEmpty = errors.New("queue name can not be empty")
+	ErrJobNotFound    = errors.New("job not found")
+)
+
+// Job 队列中的任务
+type Job struct {
+	ID          int64
+	Queue       string
+	Payload     string
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	CreatedAt   time.Time
+}
+
+// Decode 将JSON payload解析到v
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+type Queue struct {
+	name        string
+	table       string
+	maxAttempts int
+}
+
+type Option func(q *Queue)
+
+// Table 任务表名，默认zsql_jobs，多个队列可共用一张表
+func Table(table string) Option {
+	return func(q *Queue) {
+		if table != "" {
+			q.table = table
+		}
+	}
+}
+
+// MaxAttempts 默认最大尝试次数，默认25
+func MaxAttempts(n int) Option {
+	return func(q *Queue) {
+		if n > 0 {
+			q.maxAttempts = n
+		}
+	}
+}
+
+func New(name string, opts ...Option) (*Queue, error) {
+	if name == "" {
+		return nil, ErrQueueNameEmpty
+	}
+	q := &Queue{name: name, table: defaultTable, maxAttempts: defaultMaxAttempts}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q, nil
+}
+
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// Install 创建任务表
+func (q *Queue) Install(db *zsql.DB) error {
+	var ddl []string
+	switch db.Dialect() {
+	case "mysql":
+		ddl = []string{
+			"CREATE TABLE IF NOT EXISTS " + q.table + " (" +
+				"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+				"queue VARCHAR(255) NOT NULL, " +
+				"payload LONGTEXT NOT NULL, " +
+				"status VARCHAR(16) NOT NULL, " +
+				"attempts INT NOT NULL DEFAULT 0, " +
+				"max_attempts INT NOT NULL, " +
+				"run_at DATETIME(6) NOT NULL, " +
+				"locked_until DATETIME(6) NULL, " +
+				"last_error TEXT NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"INDEX idx_" + q.table + "_fetch (queue, status, run_at))",
+		}
+	default:
+		ddl = []string{
+			"CREATE TABLE IF NOT EXISTS " + q.table + " (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"queue VARCHAR(255) NOT NULL, " +
+				"payload TEXT NOT NULL, " +
+				"status VARCHAR(16) NOT NULL, " +
+				"attempts INT NOT NULL DEFAULT 0, " +
+				"max_attempts INT NOT NULL, " +
+				"run_at TIMESTAMPTZ NOT NULL, " +
+				"locked_until TIMESTAMPTZ NULL, " +
+				"last_error TEXT NULL, " +
+				"created_at TIMESTAMPTZ NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS idx_" + q.table + "_fetch ON " + q.table + " (queue, status, run_at)",
+		}
+	}
+	return db.Transaction(context.Background(), func(tx *zsql.DB) error {
+		for _, statement := range ddl {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type enqueueOptions struct {
+	runAt       time.Time
+	maxAttempts int
+}
+
+type EnqueueOption func(o *enqueueOptions)
+
+// RunAt 任务最早执行时间
+func RunAt(t time.Time) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.runAt = t
+	}
+}
+
+// Delay 延迟d后执行
+func Delay(d time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.runAt = time.Now().Add(d)
+	}
+}
+
+// Attempts 覆盖队列的最大尝试次数
+func Attempts(n int) EnqueueOption {
+	return func(o *enqueueOptions) {
+		if n > 0 {
+			o.maxAttempts = n
+		}
+	}
+}
+
+// Enqueue 写入任务，db为Begin返回的事务时随事务提交，
+// payload为string、[]byte或可JSON序列化的值
+func (q *Queue) Enqueue(db *zsql.DB, payload interface{}, opts ...EnqueueOption) error {
+	now := time.Now()
+	o := &enqueueOptions{runAt: now, maxAttempts: q.maxAttempts}
+	for _, opt := range opts {
+		opt(o)
+	}
+	var data string
+	switch v := payload.(type) {
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	return db.Exec(db.Rebind("INSERT INTO "+q.table+" (queue, payload, status, attempts, max_attempts, run_at, created_at) VALUES (?, ?, ?, 0, ?, ?, ?)"),
+		q.name, data, statusPending, o.maxAttempts, o.runAt, now).Error
+}
+
+// Dead 查询已进入死信状态的任务
+func (q *Queue) Dead(db *zsql.DB, limit int) ([]Job, error) {
+	var jobs []Job
+	err := db.Query(db.Rebind("SELECT id, queue, payload, attempts, max_attempts, run_at, created_at FROM "+q.table+" WHERE queue = ? AND status = ? ORDER BY id"),
+		q.name, statusDead).Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+// Retry 将死信任务重置为待执行
+func (q *Queue) Retry(db *zsql.DB, id int64) error {
+	tx := db.Exec(db.Rebind("UPDATE "+q.table+" SET status = ?, attempts = 0, run_at = ?, locked_until = NULL WHERE id = ? AND queue = ? AND status = ?"),
+		statusPending, time.Now(), id, q.name, statusDead)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
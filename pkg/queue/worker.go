@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/luoskak/logger"
+	"github.com/luoskak/zsql"
+)
+
+const (
+	defaultConcurrency  = 1
+	defaultVisibility   = 5 * time.Minute
+	defaultPollInterval = time.Second
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = time.Hour
+	maxErrorLength      = 1024
+)
+
+// Handler 处理任务，返回错误或panic时按退避重试
+type Handler interface {
+	Handle(ctx context.Context, job *Job) error
+}
+
+// HandlerFunc func adapter of Handler
+type HandlerFunc func(ctx context.Context, job *Job) error
+
+func (f HandlerFunc) Handle(ctx context.Context, job *Job) error {
+	return f(ctx, job)
+}
+
+type Worker struct {
+	queue        *Queue
+	db           *zsql.DB
+	handler      Handler
+	concurrency  int
+	visibility   time.Duration
+	pollInterval time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	log          *logger.Logger
+}
+
+type WorkerOption func(w *Worker)
+
+// Concurrency 同时处理的任务数，默认1
+func Concurrency(n int) WorkerOption {
+	return func(w *Worker) {
+		if n > 0 {
+			w.concurrency = n
+		}
+	}
+}
+
+// Visibility 可见性超时，认领后超过该时间未完成的任务可被重新认领，
+// 同时作为Handler的ctx超时，默认5m
+func Visibility(d time.Duration) WorkerOption {
+	return func(w *Worker) {
+		if d > 0 {
+			w.visibility = d
+		}
+	}
+}
+
+// PollInterval 队列为空时的轮询间隔，默认1s
+func PollInterval(d time.Duration) WorkerOption {
+	return func(w *Worker) {
+		if d > 0 {
+			w.pollInterval = d
+		}
+	}
+}
+
+// Backoff 失败重试间隔，按尝试次数指数增长，默认1s到1h
+func Backoff(min, max time.Duration) WorkerOption {
+	return func(w *Worker) {
+		if min > 0 && max >= min {
+			w.minBackoff = min
+			w.maxBackoff = max
+		}
+	}
+}
+
+func (q *Queue) Worker(db *zsql.DB, handler Handler, opts ...WorkerOption) *Worker {
+	w := &Worker{
+		queue:        q,
+		db:           db,
+		handler:      handler,
+		concurrency:  defaultConcurrency,
+		visibility:   defaultVisibility,
+		pollInterval: defaultPollInterval,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		log:          logger.NewLogger("Queue:%s", q.name),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run 启动worker直到ctx结束，等待处理中的任务返回
+func (w *Worker) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := w.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			w.log.Error("claim job failed: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(w.pollInterval):
+			}
+			continue
+		}
+		w.process(ctx, job)
+	}
+}
+
+// claim 认领一个到期任务，尝试次数在认领时增加，
+// 超时未完成且已用完次数的任务直接进入死信
+func (w *Worker) claim(ctx context.Context) (*Job, error) {
+	var claimed *Job
+	err := w.db.Transaction(ctx, func(tx *zsql.DB) error {
+		table := w.queue.table
+		now := time.Now()
+		var jobs []Job
+		tx.Query(tx.Rebind("SELECT id, queue, payload, attempts, max_attempts, run_at, created_at FROM "+table+
+			" WHERE queue = ? AND status = ? AND run_at <= ? AND (locked_until IS NULL OR locked_until <= ?)"), w.queue.name, statusPending, now, now).
+			Order([][]string{{"run_at", "ASC"}, {"id", "ASC"}}).Limit(1).
+			Locking(zsql.Locking{Options: zsql.LockingOptionsSkipLocked}).
+			Find(&jobs)
+		if tx.Error != nil {
+			return tx.Error
+		}
+		// 事务中的Statement共用，执行更新前清除查询子句
+		tx.Reset()
+		if len(jobs) == 0 {
+			return nil
+		}
+		job := jobs[0]
+		if job.Attempts >= job.MaxAttempts {
+			return tx.Exec(tx.Rebind("UPDATE "+table+" SET status = ?, locked_until = NULL, last_error = ? WHERE id = ?"),
+				statusDead, "visibility timeout exceeded", job.ID).Error
+		}
+		job.Attempts++
+		if err := tx.Exec(tx.Rebind("UPDATE "+table+" SET attempts = ?, locked_until = ? WHERE id = ?"),
+			job.Attempts, now.Add(w.visibility), job.ID).Error; err != nil {
+			return err
+		}
+		claimed = &job
+		return nil
+	})
+	return claimed, err
+}
+
+func (w *Worker) process(ctx context.Context, job *Job) {
+	hctx, cancel := context.WithTimeout(ctx, w.visibility)
+	err := w.handle(hctx, job)
+	cancel()
+	// 结果使用独立的context写入，worker退出时也能记录
+	if err == nil {
+		err = w.complete(job)
+	} else {
+		err = w.fail(job, err)
+	}
+	if err != nil {
+		w.log.Error("ack job %d failed: %v", job.ID, err)
+	}
+}
+
+func (w *Worker) handle(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return w.handler.Handle(ctx, job)
+}
+
+// complete 成功的任务直接删除，attempts条件保证任务未被重新认领
+func (w *Worker) complete(job *Job) error {
+	return w.db.Exec(w.db.Rebind("DELETE FROM "+w.queue.table+" WHERE id = ? AND attempts = ?"), job.ID, job.Attempts).Error
+}
+
+func (w *Worker) fail(job *Job, cause error) error {
+	lastError := cause.Error()
+	if len(lastError) > maxErrorLength {
+		lastError = lastError[:maxErrorLength]
+	}
+	if job.Attempts >= job.MaxAttempts {
+		w.log.Warn("job %d dead after %d attempts: %s", job.ID, job.Attempts, lastError)
+		return w.db.Exec(w.db.Rebind("UPDATE "+w.queue.table+" SET status = ?, locked_until = NULL, last_error = ? WHERE id = ? AND attempts = ?"),
+			statusDead, lastError, job.ID, job.Attempts).Error
+	}
+	return w.db.Exec(w.db.Rebind("UPDATE "+w.queue.table+" SET run_at = ?, locked_until = NULL, last_error = ? WHERE id = ? AND attempts = ?"),
+		time.Now().Add(w.backoff(job.Attempts)), lastError, job.ID, job.Attempts).Error
+}
+
+func (w *Worker) backoff(attempts int) time.Duration {
+	backoff := w.minBackoff
+	for i := 1; i < attempts && backoff < w.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > w.maxBackoff {
+		backoff = w.maxBackoff
+	}
+	return backoff
+}
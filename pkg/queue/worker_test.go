@@ -0,0 +1,61 @@
+package queue
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luoskak/mist"
+	"github.com/luoskak/zsql"
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDB(handler fakedb.Handler) (*zsql.DB, *fakedb.Source) {
+	source := fakedb.New(handler)
+	mw := &zsql.Middleware{}
+	mw.Init([]mist.Option{zsql.MysqlAddress("", source.DSN(), source.DSN()+"?"), zsql.Log(zsql.LogSilent)})
+	var db *zsql.DB
+	mw.Inter(false)(context.Background(), nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		db = zsql.Get(ctx)
+		return nil, nil
+	})
+	return db, source
+}
+
+func TestClaim(t *testing.T) {
+	runAt := time.Now().Add(-time.Minute)
+	db, source := newDB(func(sql string, args []interface{}) fakedb.Result {
+		if !strings.HasPrefix(sql, "SELECT") {
+			return fakedb.Result{RowsAffected: 1}
+		}
+		return fakedb.Result{
+			Columns: []string{"id", "queue", "payload", "attempts", "max_attempts", "run_at", "created_at"},
+			Rows:    [][]interface{}{{int64(7), "mail", "{}", int64(1), int64(3), runAt, runAt}},
+		}
+	})
+	q, err := New("mail")
+	assert.Nil(t, err)
+	w := q.Worker(db, HandlerFunc(func(ctx context.Context, job *Job) error { return nil }), Visibility(time.Minute))
+
+	job, err := w.claim(context.Background())
+	assert.Nil(t, err)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, int64(7), job.ID)
+		assert.Equal(t, 2, job.Attempts)
+	}
+
+	calls := source.Calls()
+	assert.Equal(t, []string{
+		fakedb.Begin,
+		"SELECT id, queue, payload, attempts, max_attempts, run_at, created_at FROM zsql_jobs " +
+			"WHERE queue = ? AND status = ? AND run_at <= ? AND (locked_until IS NULL OR locked_until <= ?) " +
+			"ORDER BY run_at,id LIMIT 1 FOR UPDATE SKIP LOCKED",
+		"UPDATE zsql_jobs SET attempts = ?, locked_until = ? WHERE id = ?",
+		fakedb.Commit,
+	}, source.SQL())
+	assert.Equal(t, []interface{}{"mail", statusPending}, calls[1].Args[:2])
+	assert.Equal(t, int64(2), calls[2].Args[0])
+	assert.Equal(t, int64(7), calls[2].Args[2])
+}
@@ -45,6 +45,7 @@ func (schema *Schema) ParseField(fieldStruct reflect.StructField) *Field {
 		FieldType:         fieldStruct.Type,
 		IndirectFieldType: fieldStruct.Type,
 		StructField:       fieldStruct,
+		TagSettings:       ParseTagSetting(fieldStruct.Tag.Get("zsql"), ";"),
 	}
 
 	for field.IndirectFieldType.Kind() == reflect.Ptr {
@@ -128,3 +128,16 @@ func (schema Schema) LookUpField(name string) *Field {
 	}
 	return nil
 }
+
+// PrimaryField 主键字段，标记了 zsql:"primaryKey" 的字段，没有时为ID字段
+func (schema Schema) PrimaryField() *Field {
+	for _, field := range schema.Fields {
+		if _, ok := field.TagSettings["PRIMARYKEY"]; ok && field.DBName != "" {
+			return field
+		}
+	}
+	if field, ok := schema.FieldsByName["ID"]; ok && field.DBName != "" {
+		return field
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var zsqlSourceDir string
+
+func init() {
+	_, file, _, _ := runtime.Caller(0)
+	zsqlSourceDir = regexp.MustCompile(`pkg.utils.utils\.go`).ReplaceAllString(file, "")
+}
+
+// FileWithLineNum 返回zsql之外第一个调用者的位置
+func FileWithLineNum() string {
+	for i := 2; i < 15; i++ {
+		_, file, line, ok := runtime.Caller(i)
+		if ok && (!strings.HasPrefix(file, zsqlSourceDir) || strings.HasSuffix(file, "_test.go")) {
+			return file + ":" + strconv.FormatInt(int64(line), 10)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,203 @@
+package zsql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/luoskak/plant/pkg/rxjs"
+	"github.com/luoskak/plant/pkg/rxjs/abstract"
+)
+
+const (
+	defaultNotifyTable     = "zsql_notifications"
+	defaultPollInterval    = time.Second
+	defaultNotifyRetention = time.Hour
+	defaultNotifyLookback  = time.Minute
+	pollBatchSize          = 100
+)
+
+// crdbDetector 缓存是否为CockroachDB，其不支持LISTEN / NOTIFY
+type crdbDetector struct {
+	mu      sync.Mutex
+	checked bool
+	crdb    bool
+}
+
+// nativeListen 是否支持LISTEN / NOTIFY，否则使用通知表轮询
+func (db *DB) nativeListen(ctx context.Context) bool {
+	if db.listener == nil {
+		return false
+	}
+	d := &db.listener.crdb
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.checked {
+		var version string
+		if err := db.rConn.QueryRowContext(ctx, "select version()").Scan(&version); err != nil {
+			// 无法判断时按postgres处理，下次再检查
+			return true
+		}
+		d.checked = true
+		d.crdb = strings.Contains(version, "CockroachDB")
+	}
+	return !d.crdb
+}
+
+func (db *DB) notifyTable() string {
+	if db.opts.notifyTable != "" {
+		return db.opts.notifyTable
+	}
+	return defaultNotifyTable
+}
+
+// InstallNotifyTable 创建轮询模式使用的通知表
+func (db *DB) InstallNotifyTable(ctx context.Context) error {
+	tx := db.getInstance()
+	tx.Statement.Context = ctx
+	table := tx.notifyTable()
+	var ddl []string
+	switch tx.dialect {
+	case "mysql":
+		ddl = []string{
+			"CREATE TABLE IF NOT EXISTS " + table + " (" +
+				"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+				"channel VARCHAR(63) NOT NULL, " +
+				"payload TEXT NOT NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"INDEX idx_" + table + "_channel (channel, id), " +
+				"INDEX idx_" + table + "_created_at (created_at))",
+		}
+	default:
+		ddl = []string{
+			"CREATE TABLE IF NOT EXISTS " + table + " (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"channel VARCHAR(63) NOT NULL, " +
+				"payload TEXT NOT NULL, " +
+				"created_at TIMESTAMPTZ NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS idx_" + table + "_channel ON " + table + " (channel, id)",
+			"CREATE INDEX IF NOT EXISTS idx_" + table + "_created_at ON " + table + " (created_at)",
+		}
+	}
+	for _, statement := range ddl {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollNotify 写入通知表，在事务中调用时提交后才可见
+func (db *DB) pollNotify(channel, payload string) error {
+	return db.Exec(db.Rebind("INSERT INTO "+db.notifyTable()+" (channel, payload, created_at) VALUES (?, ?, ?)"), channel, payload, time.Now()).Error
+}
+
+type polledNotification struct {
+	ID      int64
+	Channel string
+	Payload string
+}
+
+// pollListen 按id轮询通知表，只投递订阅之后写入的通知。较小的id可能晚于较大的id提交，
+// 因此每次轮询重新扫描lookback内写入的通知并跳过已投递的id，写入后超过lookback才提交的仍会丢失；
+// 定期删除游标之前且超过保留时长(不小于lookback)的记录
+func (db *DB) pollListen(ctx context.Context, channel string, deliver func(observer rxjs.Observer, n *pgconn.Notification)) abstract.Observable {
+	interval := db.opts.pollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	lookback := db.opts.notifyLookback
+	if lookback <= 0 {
+		lookback = defaultNotifyLookback
+	}
+	retention := db.opts.notifyRetention
+	if retention <= 0 {
+		retention = defaultNotifyRetention
+	}
+	if retention < lookback {
+		retention = lookback
+	}
+	table := db.notifyTable()
+	// 每次查询使用独立的会话，订阅之间不共用Statement，出错后下次轮询重试
+	session := func() *DB {
+		tx := db.contextSession(ctx)
+		tx.Statement.ConnPool = nil
+		return tx
+	}
+	logError := func(action string, err error) {
+		if ctx.Err() == nil {
+			db.log.Error("%s notifications on %s failed: %v", action, channel, err)
+		}
+	}
+	return rxjs.Observable(func(observer rxjs.Observer) {
+		var (
+			// base 订阅时的最大id，之前的通知不投递
+			base int64
+			// cursor 已投递的最大id
+			cursor      int64
+			initialized bool
+			// seen 已投递的id及投递时间，超过两倍lookback后不会再被扫描到
+			seen      = make(map[int64]time.Time)
+			lastPrune time.Time
+			ticker    = time.NewTicker(interval)
+		)
+		defer ticker.Stop()
+		for {
+			if !initialized {
+				var max sql.NullInt64
+				tx := session().Query(db.Rebind("SELECT MAX(id) FROM "+table+" WHERE channel = ?"), channel).Find(&max)
+				if tx.Error != nil {
+					logError("init", tx.Error)
+				} else {
+					initialized = true
+					base, cursor = max.Int64, max.Int64
+				}
+			}
+			after := base
+			for initialized {
+				var rows []polledNotification
+				tx := session().Query(db.Rebind("SELECT id, channel, payload FROM "+table+
+					" WHERE channel = ? AND id > ? AND (id > ? OR created_at >= ?) ORDER BY id LIMIT ?"),
+					channel, after, cursor, time.Now().Add(-lookback), pollBatchSize).Find(&rows)
+				if tx.Error != nil {
+					logError("poll", tx.Error)
+					break
+				}
+				now := time.Now()
+				for _, row := range rows {
+					after = row.ID
+					if _, ok := seen[row.ID]; ok {
+						continue
+					}
+					seen[row.ID] = now
+					if row.ID > cursor {
+						cursor = row.ID
+					}
+					deliver(observer, &pgconn.Notification{Channel: row.Channel, Payload: row.Payload})
+				}
+				if len(rows) < pollBatchSize {
+					break
+				}
+			}
+			for id, at := range seen {
+				if time.Since(at) > 2*lookback {
+					delete(seen, id)
+				}
+			}
+			if initialized && time.Since(lastPrune) > retention/2 {
+				if err := session().Exec(db.Rebind("DELETE FROM "+table+" WHERE channel = ? AND id <= ? AND created_at < ?"), channel, cursor, time.Now().Add(-retention)).Error; err != nil {
+					logError("prune", err)
+				}
+				lastPrune = time.Now()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
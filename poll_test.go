@@ -0,0 +1,160 @@
+package zsql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/luoskak/plant/pkg/rxjs"
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+type chanObserver chan interface{}
+
+func (c chanObserver) Next(v interface{}) {
+	c <- v
+}
+
+func TestPollListenRetriesAfterError(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		polls int
+	)
+	db, _ := newFakeDB(func(sql string, args []interface{}) fakedb.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(sql, "SELECT MAX(id)"):
+			return fakedb.Result{Columns: []string{"max"}, Rows: [][]interface{}{{int64(3)}}}
+		case strings.HasPrefix(sql, "SELECT id, channel, payload"):
+			polls++
+			switch polls {
+			case 1:
+				return fakedb.Result{Err: errors.New("connection reset")}
+			case 2:
+				return fakedb.Result{Columns: []string{"id", "channel", "payload"}, Rows: [][]interface{}{{int64(4), "jobs", "hello"}}}
+			}
+			return fakedb.Result{Columns: []string{"id", "channel", "payload"}}
+		}
+		return fakedb.Result{}
+	})
+	db.opts.pollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx := db.getInstance()
+	deliver := func(observer rxjs.Observer, n *pgconn.Notification) {
+		observer.Next(n.Payload)
+	}
+	received := make(chanObserver, 2)
+	// 两个订阅各自轮询，互不影响
+	tx.pollListen(ctx, "jobs", deliver).Subscribe(received)
+	tx.pollListen(ctx, "jobs", deliver).Subscribe(received)
+
+	select {
+	case v := <-received:
+		assert.Equal(t, "hello", v)
+	case <-time.After(time.Second):
+		t.Fatal("polling stopped after an error")
+	}
+	assert.Nil(t, tx.Error)
+}
+
+// fakeNotification 通知表中的一行，visible为false时写入事务尚未提交
+type fakeNotification struct {
+	id        int64
+	payload   string
+	createdAt time.Time
+	visible   bool
+}
+
+func TestPollListenOutOfOrderCommit(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		now     = time.Now()
+		table   []*fakeNotification
+		deletes [][]interface{}
+	)
+	insert := func(id int64, payload string, createdAt time.Time, visible bool) *fakeNotification {
+		mu.Lock()
+		defer mu.Unlock()
+		row := &fakeNotification{id: id, payload: payload, createdAt: createdAt, visible: visible}
+		table = append(table, row)
+		return row
+	}
+	db, _ := newFakeDB(func(sql string, args []interface{}) fakedb.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(sql, "SELECT MAX(id)"):
+			return fakedb.Result{Columns: []string{"max"}, Rows: [][]interface{}{{int64(3)}}}
+		case strings.HasPrefix(sql, "SELECT id, channel, payload"):
+			after, cursor, since, limit := args[1].(int64), args[2].(int64), args[3].(time.Time), args[4].(int64)
+			result := fakedb.Result{Columns: []string{"id", "channel", "payload"}}
+			for _, row := range table {
+				if row.visible && row.id > after && (row.id > cursor || !row.createdAt.Before(since)) && int64(len(result.Rows)) < limit {
+					result.Rows = append(result.Rows, []interface{}{row.id, "jobs", row.payload})
+				}
+			}
+			return result
+		case strings.HasPrefix(sql, "DELETE"):
+			deletes = append(deletes, args)
+		}
+		return fakedb.Result{}
+	})
+	db.opts.pollInterval = 5 * time.Millisecond
+	db.opts.notifyRetention = time.Millisecond
+	db.opts.notifyLookback = time.Minute
+
+	// 订阅之前的通知不投递
+	insert(2, "before", now, true)
+	four := insert(4, "four", now, false)
+	insert(5, "five", now, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chanObserver, 8)
+	db.getInstance().pollListen(ctx, "jobs", func(observer rxjs.Observer, n *pgconn.Notification) {
+		observer.Next(n.Payload)
+	}).Subscribe(received)
+
+	next := func() interface{} {
+		select {
+		case v := <-received:
+			return v
+		case <-time.After(time.Second):
+			t.Fatal("notification not delivered")
+			return nil
+		}
+	}
+	assert.Equal(t, "five", next())
+
+	// id 4的事务在5之后提交
+	mu.Lock()
+	four.visible = true
+	mu.Unlock()
+	assert.Equal(t, "four", next())
+
+	// 超过lookback但id在游标之后的通知仍投递
+	insert(6, "six", now.Add(-time.Hour), true)
+	assert.Equal(t, "six", next())
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case v := <-received:
+		t.Fatalf("duplicate delivery %v", v)
+	default:
+	}
+
+	// 清理不删除lookback内的记录
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.NotEmpty(t, deletes) {
+		assert.True(t, deletes[0][2].(time.Time).Before(time.Now().Add(-time.Minute+time.Second)))
+	}
+}
@@ -0,0 +1,52 @@
+package zsql
+
+import (
+	"strings"
+
+	"github.com/luoskak/zsql/pkg/parser"
+)
+
+var _ parser.Redactor = statementRedactor{}
+
+// statementRedactor 依次使用自定义Redactor、SensitiveColumns注册的列
+// 及模型上标记了 zsql:"sensitive" 的字段对日志参数脱敏
+type statementRedactor struct {
+	st *Statement
+}
+
+func (r statementRedactor) Redact(column string, value interface{}) (string, bool) {
+	opts := r.st.DB.opts
+	if opts.redactor != nil {
+		if replacement, ok := opts.redactor.Redact(column, value); ok {
+			return replacement, true
+		}
+	}
+	if column == "" || !r.st.sensitive(column) {
+		return "", false
+	}
+	if opts.sensitiveMask != nil {
+		return opts.sensitiveMask(value), true
+	}
+	return parser.Mask(value), true
+}
+
+func (st *Statement) sensitive(column string) bool {
+	if idx := strings.LastIndexByte(column, '.'); idx >= 0 {
+		column = column[idx+1:]
+	}
+	if _, ok := st.DB.opts.sensitiveColumns[strings.ToLower(column)]; ok {
+		return true
+	}
+	if st.Schema != nil {
+		if field := st.Schema.LookUpField(column); field != nil {
+			_, ok := field.TagSettings["SENSITIVE"]
+			return ok
+		}
+	}
+	return false
+}
+
+// explainSQL 展开参数并脱敏，用于日志
+func (st *Statement) explainSQL(sql string) string {
+	return parser.ExplainSQL(sql, nil, "'", parser.Redact(statementRedactor{st: st}, st.varColumns, st.Vals)...)
+}
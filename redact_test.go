@@ -0,0 +1,123 @@
+package zsql
+
+import (
+	"testing"
+
+	"github.com/luoskak/zsql/pkg/parser"
+	"github.com/luoskak/zsql/pkg/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+type redactUser struct {
+	ID       int64
+	Name     string
+	Password string `zsql:"sensitive"`
+	Token    string
+}
+
+func TestRedactSQL(t *testing.T) {
+	sc, err := schema.Parse(&redactUser{}, newTestDB("mysql").opts.cacheStore, schema.NamingStrategy{})
+	assert.Nil(t, err)
+	hash := parser.Hash("secret")
+	// 未设置标签的字段TagSettings也不为nil
+	assert.NotNil(t, sc.LookUpField("Name").TagSettings)
+	_, ok := sc.LookUpField("password").TagSettings["SENSITIVE"]
+	assert.True(t, ok)
+
+	cases := []struct {
+		name    string
+		columns []string
+		mask    func(value interface{}) string
+		build   func(db *DB) *DB
+		want    string
+	}{
+		{
+			name:  "tag",
+			build: func(db *DB) *DB { return db.Where("name", "=", "tom").Where("password", "=", "secret") },
+			want:  "SELECT * FROM users WHERE name = 'tom' AND password = '***'",
+		},
+		{
+			name:  "tag with table prefix",
+			build: func(db *DB) *DB { return db.Where("u.password", "IN", []interface{}{"a", "b"}) },
+			want:  "SELECT * FROM users WHERE u.password IN('***','***')",
+		},
+		{
+			name:    "columns",
+			columns: []string{"TOKEN"},
+			build:   func(db *DB) *DB { return db.Where("token", "=", "t1").Where("id", "=", 1) },
+			want:    "SELECT * FROM users WHERE token = '***' AND id = 1",
+		},
+		{
+			name:  "named",
+			build: func(db *DB) *DB { return db.Where(map[string]interface{}{"password": "secret"}) },
+			want:  "SELECT * FROM users WHERE password = '***'",
+		},
+		{
+			name:  "hash",
+			mask:  parser.Hash,
+			build: func(db *DB) *DB { return db.Where("password", "=", "secret") },
+			want:  "SELECT * FROM users WHERE password = '" + hash + "'",
+		},
+		{
+			// 原生条件无法得知列名，不脱敏
+			name:  "positional",
+			build: func(db *DB) *DB { return db.Where("password = ?", "secret") },
+			want:  "SELECT * FROM users WHERE password = 'secret'",
+		},
+		{
+			name: "sub query",
+			build: func(db *DB) *DB {
+				return db.Where("id", "IN", newTestDB("mysql").Query("SELECT id FROM users").Where("password", "=", "secret"))
+			},
+			want: "SELECT * FROM users WHERE id IN (SELECT id FROM users WHERE password = '***')",
+		},
+	}
+	for _, c := range cases {
+		db := newTestDB("mysql")
+		db.opts.sensitiveMask = c.mask
+		for _, column := range c.columns {
+			SensitiveColumns(column).Apply(db.opts)
+		}
+		tx := c.build(db.Query("SELECT * FROM users"))
+		tx.Statement.Schema = sc
+		sql, _ := buildSQL(tx)
+		assert.Equal(t, c.want, tx.Statement.explainSQL(sql), c.name)
+		// 只影响日志，参数不变
+		assert.NotContains(t, tx.Statement.Vals, parser.Masked("***"), c.name)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	db := newTestDB("mysql")
+	var columns []string
+	db.opts.redactor = parser.RedactorFunc(func(column string, value interface{}) (string, bool) {
+		columns = append(columns, column)
+		if s, ok := value.(string); ok && len(s) == 11 {
+			return "<phone>", true
+		}
+		return "", false
+	})
+	tx := db.Query("SELECT * FROM users").Where("note = ?", "13800138000").Where("phone", "=", "13900139000").Where("id", "=", 1)
+	sql, _ := buildSQL(tx)
+	assert.Equal(t, "SELECT * FROM users WHERE note = '<phone>' AND phone = '<phone>' AND id = 1", tx.Statement.explainSQL(sql))
+	// 位置参数的列名为空
+	assert.Equal(t, []string{"", "phone", "id"}, columns)
+}
+
+func TestMaskHash(t *testing.T) {
+	assert.Equal(t, "***", parser.Mask("secret"))
+	assert.Equal(t, "***", parser.Mask(nil))
+	assert.Equal(t, parser.Hash("secret"), parser.Hash("secret"))
+	assert.NotEqual(t, parser.Hash("secret"), parser.Hash("secret2"))
+	assert.Regexp(t, `^sha256:[0-9a-f]{12}$`, parser.Hash(42))
+
+	vars := []interface{}{"a", "b"}
+	assert.Equal(t, vars, parser.Redact(nil, nil, vars))
+	redacted := parser.Redact(parser.RedactorFunc(func(column string, value interface{}) (string, bool) {
+		return "x", column == "password"
+	}), []string{"password"}, vars)
+	assert.Equal(t, []interface{}{parser.Masked("x"), "b"}, redacted)
+	assert.Equal(t, []interface{}{"a", "b"}, vars)
+	assert.Equal(t, "a = 'x', b = 'b'", parser.ExplainSQL("a = ?, b = ?", nil, "'", redacted...))
+	assert.Equal(t, "a = 'x', b = NULL", parser.ExplainSQL("a = ?, b = ?", nil, "'", parser.Masked("x"), nil))
+}
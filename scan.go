@@ -84,6 +84,8 @@ func Scan(rows *sql.Rows, db *DB) {
 				for idx, column := range columns {
 					if field := sc.LookUpField(column); field != nil {
 						fields[idx] = field
+					} else if column == windowTotalColumn && db.Statement.windowTotal != nil {
+						values[idx] = db.Statement.windowTotal
 					} else {
 						values[idx] = &sql.RawBytes{}
 					}
@@ -2,6 +2,7 @@ package zsql
 
 import (
 	"context"
+	"database/sql"
 	"reflect"
 	"strings"
 
@@ -26,6 +27,16 @@ type Statement struct {
 	BuildClauses []string
 	ReflectValue reflect.Value
 	Table        string
+	// txSpan 事务span，Commit或Rollback时结束
+	txSpan    Span
+	txOptions *sql.TxOptions
+	// varColumns 与Vals按下标对应的列名，用于日志脱敏
+	varColumns []string
+	// strict 严格校验列名，见DB.Strict
+	strict       bool
+	allowColumns map[string]struct{}
+	// windowTotal Paginate的Window模式下接收COUNT(*) OVER()
+	windowTotal *int64
 }
 
 func (st *Statement) clone() *Statement {
@@ -62,7 +73,17 @@ func (st *Statement) WriteQuoted(value interface{}) {
 			st.WriteString(nn)
 			return
 		}
+		if st.strictIdentifiers() {
+			st.writeIdentifier(v)
+			return
+		}
 		st.WriteString(v)
+	case tableName:
+		if nn, has := st.NameMapper[string(v)]; has {
+			st.WriteString(nn)
+			return
+		}
+		st.WriteString(string(v))
 	}
 }
 
@@ -78,6 +99,17 @@ func (st *Statement) AddVar(vars ...interface{}) {
 
 }
 
+func (st *Statement) AddFieldVar(field string, vars ...interface{}) {
+	st.padVarColumns()
+	for _, val := range vars {
+		if _, ok := val.(map[string]interface{}); ok {
+			continue
+		}
+		st.Vals = append(st.Vals, val)
+		st.varColumns = append(st.varColumns, field)
+	}
+}
+
 func (st *Statement) AddClause(v IClause) {
 	name := v.Name()
 	c := st.Clauses[name]
@@ -90,12 +122,57 @@ func (st *Statement) Build(clauses ...string) {
 
 	for _, name := range clauses {
 		if c, ok := st.Clauses[name]; ok {
+			if name == "WITH" {
+				st.prepend(c)
+				continue
+			}
 			st.WriteString(" ")
 			c.Build(st)
 		}
 	}
 }
 
+// prepend 将子句及其参数置于语句之前，用于WITH
+func (st *Statement) prepend(c Clause) {
+	prefix := st.derive()
+	c.Build(prefix)
+	prefix.padVarColumns()
+	st.padVarColumns()
+
+	sql := prefix.SQL.String() + " " + st.SQL.String()
+	st.SQL.Reset()
+	st.SQL.WriteString(sql)
+	st.Vals = append(prefix.Vals, st.Vals...)
+	st.varColumns = append(prefix.varColumns, st.varColumns...)
+}
+
+// derive 共用DB、子句及校验设置的空语句，用于单独构建语句片段
+func (st *Statement) derive() *Statement {
+	return &Statement{
+		DB:           st.DB,
+		Schema:       st.Schema,
+		Table:        st.Table,
+		Clauses:      st.Clauses,
+		NameMapper:   st.NameMapper,
+		strict:       st.strict,
+		allowColumns: st.allowColumns,
+	}
+}
+
+// padVarColumns 补齐varColumns使其与Vals对应
+func (st *Statement) padVarColumns() {
+	for len(st.varColumns) < len(st.Vals) {
+		st.varColumns = append(st.varColumns, "")
+	}
+}
+
+// resetSQL 执行完毕后清空语句及参数
+func (st *Statement) resetSQL() {
+	st.SQL.Reset()
+	st.Vals = nil
+	st.varColumns = nil
+}
+
 func (st *Statement) Reset() (tx *DB) {
 	tx = st.getInstance()
 	tx.Statement.Model = nil
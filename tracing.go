@@ -0,0 +1,135 @@
+package zsql
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/luoskak/zsql/pkg/parser"
+)
+
+// span attribute keys
+const (
+	AttrDBName      = "db.name"
+	AttrDBSystem    = "db.system"
+	AttrDBOperation = "db.operation"
+	AttrDBTable     = "db.sql.table"
+	AttrDBStatement = "db.statement"
+)
+
+// Tracer starts a span per statement and per transaction
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span)
+}
+
+type Span interface {
+	RecordError(err error)
+	End()
+}
+
+// TraceParenter 实现该接口的Span可生成sqlcommenter所需的w3c traceparent
+type TraceParenter interface {
+	TraceParent() string
+}
+
+var (
+	tableExp      = regexp.MustCompile("(?i)\\b(?:from|into|update|join)\\s+([`\"\\w.]+)")
+	whitespaceExp = regexp.MustCompile(`\s+`)
+)
+
+// normalizeSQL 合并空白字符
+func normalizeSQL(sql string) string {
+	return strings.TrimSpace(whitespaceExp.ReplaceAllString(sql, " "))
+}
+
+func tableOf(st *Statement, sql string) string {
+	if st.Table != "" {
+		return st.Table
+	}
+	if matches := tableExp.FindStringSubmatch(sql); len(matches) > 1 {
+		return strings.Trim(matches[1], "`\"")
+	}
+	return ""
+}
+
+// startSpan 开始语句span，未配置Tracer时span为nil
+func (db *DB) startSpan(sql string) (context.Context, Span) {
+	st := db.Statement
+	if db.opts.tracer == nil {
+		return st.Context, nil
+	}
+	operation := parser.Operation(sql)
+	return db.opts.tracer.Start(st.Context, MiddlewareName+"."+operation, map[string]string{
+		AttrDBName:      db.name,
+		AttrDBSystem:    db.dialect,
+		AttrDBOperation: operation,
+		AttrDBTable:     tableOf(st, sql),
+		AttrDBStatement: normalizeSQL(sql),
+	})
+}
+
+func endSpan(span Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+type sqlCommentKey struct{}
+
+// ContextWithSQLComment 添加sqlcommenter标签，如route、controller
+func ContextWithSQLComment(ctx context.Context, key, value string) context.Context {
+	tags := map[string]string{}
+	if old, ok := ctx.Value(sqlCommentKey{}).(map[string]string); ok {
+		for k, v := range old {
+			tags[k] = v
+		}
+	}
+	tags[key] = value
+	return context.WithValue(ctx, sqlCommentKey{}, tags)
+}
+
+// withSQLComment 按sqlcommenter规范在语句末尾追加注释
+func (db *DB) withSQLComment(ctx context.Context, sql string, span Span) string {
+	if !db.opts.sqlCommenter {
+		return sql
+	}
+	tags := map[string]string{}
+	if ctx != nil {
+		if old, ok := ctx.Value(sqlCommentKey{}).(map[string]string); ok {
+			for k, v := range old {
+				tags[k] = v
+			}
+		}
+	}
+	if tp, ok := span.(TraceParenter); ok {
+		if parent := tp.TraceParent(); parent != "" {
+			tags["traceparent"] = parent
+		}
+	}
+	if len(tags) == 0 {
+		return sql
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, sqlCommentEscape(k)+"='"+sqlCommentEscape(tags[k])+"'")
+	}
+	comment := "/*" + strings.Join(pairs, ",") + "*/"
+
+	trimmed := strings.TrimRight(sql, " \t\n;")
+	return trimmed + " " + comment + sql[len(trimmed):]
+}
+
+func sqlCommentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
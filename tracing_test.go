@@ -0,0 +1,141 @@
+package zsql
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpan struct {
+	name   string
+	attrs  map[string]string
+	parent string
+	errs   []error
+	ended  int
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *testSpan) End() {
+	s.ended++
+}
+
+func (s *testSpan) TraceParent() string {
+	return s.parent
+}
+
+type spanKey struct{}
+
+// testTracer 记录开始的span，子span可从ctx取得父span
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span) {
+	s := &testSpan{name: name, attrs: attrs, parent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestTracingSpans(t *testing.T) {
+	boom := errors.New("boom")
+	db, _ := newFakeDB(func(sql string, args []interface{}) fakedb.Result {
+		if sql == "DELETE FROM users WHERE id = ?" {
+			return fakedb.Result{Err: boom}
+		}
+		return fakedb.Result{RowsAffected: 1}
+	})
+	tracer := &testTracer{}
+	db.name = "default"
+	db.opts.tracer = tracer
+
+	assert.Nil(t, db.Exec("UPDATE users SET name = ?  WHERE\n id = ?", "a", 1).Error)
+	assert.Equal(t, boom, db.Exec("DELETE FROM users WHERE id = ?", 1).Error)
+
+	assert.Equal(t, 2, len(tracer.spans))
+	update := tracer.spans[0]
+	assert.Equal(t, "zsql.update", update.name)
+	assert.Equal(t, map[string]string{
+		AttrDBName:      "default",
+		AttrDBSystem:    "mysql",
+		AttrDBOperation: "update",
+		AttrDBTable:     "users",
+		AttrDBStatement: "UPDATE users SET name = ? WHERE id = ?",
+	}, update.attrs)
+	assert.Equal(t, 1, update.ended)
+	assert.Empty(t, update.errs)
+
+	del := tracer.spans[1]
+	assert.Equal(t, "zsql.delete", del.name)
+	assert.Equal(t, 1, del.ended)
+	assert.Equal(t, []error{boom}, del.errs)
+}
+
+func TestTracingTransaction(t *testing.T) {
+	db, _ := newFakeDB(nil)
+	tracer := &testTracer{}
+	db.opts.tracer = tracer
+
+	err := db.Transaction(context.Background(), func(tx *DB) error {
+		if tx.Statement.Context.Value(spanKey{}) != tracer.spans[0] {
+			t.Error("statement context should carry the transaction span")
+		}
+		return tx.Exec("UPDATE users SET name = ?", "a").Error
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tracer.spans))
+	assert.Equal(t, "zsql.transaction", tracer.spans[0].name)
+	assert.Equal(t, 1, tracer.spans[0].ended)
+	assert.Equal(t, 1, tracer.spans[1].ended)
+
+	boom := errors.New("boom")
+	err = db.Transaction(context.Background(), func(tx *DB) error {
+		return boom
+	})
+	assert.Equal(t, boom, err)
+	assert.Equal(t, 3, len(tracer.spans))
+	assert.Equal(t, 1, tracer.spans[2].ended)
+	assert.Empty(t, tracer.spans[2].errs)
+}
+
+func TestSQLCommenter(t *testing.T) {
+	db := newTestDB("mysql")
+	ctx := ContextWithSQLComment(context.Background(), "route", "/users/{id}")
+	ctx = ContextWithSQLComment(ctx, "controller", "it's a user")
+	span := &testSpan{parent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+
+	// 未开启时不修改语句
+	assert.Equal(t, "SELECT 1", db.withSQLComment(ctx, "SELECT 1", span))
+
+	db.opts.sqlCommenter = true
+	cases := []struct {
+		ctx  context.Context
+		span Span
+		sql  string
+		want string
+	}{
+		{ctx, nil, "SELECT 1", "SELECT 1 /*controller='it%27s%20a%20user',route='%2Fusers%2F%7Bid%7D'*/"},
+		{ctx, span, "SELECT 1;\n", "SELECT 1 /*controller='it%27s%20a%20user',route='%2Fusers%2F%7Bid%7D'," +
+			"traceparent='00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'*/;\n"},
+		{context.Background(), &testSpan{}, "SELECT 1", "SELECT 1"},
+		{nil, nil, "SELECT 1", "SELECT 1"},
+		{ContextWithSQLComment(context.Background(), "a=b", "*/ DROP"), nil, "SELECT 1", "SELECT 1 /*a%3Db='%2A%2F%20DROP'*/"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, db.withSQLComment(c.ctx, c.sql, c.span), c.sql)
+	}
+
+	// 子ctx添加标签不影响父ctx
+	child := ContextWithSQLComment(ctx, "route", "/other")
+	assert.Equal(t, "SELECT 1 /*controller='it%27s%20a%20user',route='%2Fusers%2F%7Bid%7D'*/", db.withSQLComment(ctx, "SELECT 1", nil))
+	assert.Equal(t, "SELECT 1 /*controller='it%27s%20a%20user',route='%2Fother'*/", db.withSQLComment(child, "SELECT 1", nil))
+}
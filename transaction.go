@@ -1,55 +1,109 @@
 package zsql
 
 import (
+	"context"
 	"database/sql"
 	"reflect"
 )
 
 func (db *DB) Begin(opts ...*sql.TxOptions) *DB {
-	var (
-		tx  = db.getInstance()
-		opt *sql.TxOptions
-		err error
-	)
-
+	tx := db.getInstance()
 	if len(opts) > 0 {
-		opt = opts[0]
+		tx.Statement.txOptions = opts[0]
 	}
+	return tx.callbacks.Begin().Execute(tx)
+}
+
+// begin 内置开启事务回调
+func begin(tx *DB) {
+	var err error
 	if tx.Statement.ConnPool == nil {
 		tx.Statement.ConnPool = tx.wConn
 	}
 
+	if tx.opts.tracer != nil {
+		tx.Statement.Context, tx.Statement.txSpan = tx.opts.tracer.Start(tx.Statement.Context, MiddlewareName+".transaction", map[string]string{
+			AttrDBName:   tx.name,
+			AttrDBSystem: tx.dialect,
+		})
+	}
+
 	if beginner, ok := tx.Statement.ConnPool.(TxBeginner); ok {
-		tx.Statement.ConnPool, err = beginner.BeginTx(tx.Statement.Context, opt)
+		tx.Statement.ConnPool, err = beginner.BeginTx(tx.Statement.Context, tx.Statement.txOptions)
 	} else {
 		err = ErrInvalidTransaction
 	}
 
 	if err != nil {
 		tx.AddError(err)
+		tx.observeTransaction(TxOutcomeBeginError)
+		endSpan(tx.Statement.txSpan, err)
+		tx.Statement.txSpan = nil
 	}
-	return tx
-
 }
 
 func (db *DB) Commit() *DB {
+	return db.callbacks.Commit().Execute(db)
+}
+
+// commit 内置提交回调
+func commit(db *DB) {
 	if committer, ok := db.Statement.ConnPool.(TxCommitter); ok && committer != nil && !reflect.ValueOf(committer).IsNil() {
-		db.AddError(committer.Commit())
+		err := committer.Commit()
+		if err != nil {
+			db.AddError(err)
+			db.observeTransaction(TxOutcomeCommitError)
+		} else {
+			db.observeTransaction(TxOutcomeCommit)
+		}
+		endSpan(db.Statement.txSpan, err)
+		db.Statement.txSpan = nil
 		db.Statement.ConnPool = nil
 	} else {
 		db.AddError(ErrInvalidTransaction)
 	}
-	return db
 }
 
 func (db *DB) Rollback() *DB {
+	return db.callbacks.Rollback().Execute(db)
+}
+
+// rollback 内置回滚回调
+func rollback(db *DB) {
 	if committer, ok := db.Statement.ConnPool.(TxCommitter); ok && committer != nil {
 		if !reflect.ValueOf(committer).IsNil() {
-			db.AddError(committer.Rollback())
+			err := committer.Rollback()
+			if err != nil {
+				db.AddError(err)
+				db.observeTransaction(TxOutcomeRollbackError)
+			} else {
+				db.observeTransaction(TxOutcomeRollback)
+			}
+			endSpan(db.Statement.txSpan, err)
+			db.Statement.txSpan = nil
 			db.Statement.ConnPool = nil
 		}
 	} else {
 		db.AddError(ErrInvalidTransaction)
 	}
-	return db
+}
+
+// Transaction 在事务中执行fc，开启事务及其中的语句使用ctx，
+// fc返回错误或panic时回滚，否则提交
+func (db *DB) Transaction(ctx context.Context, fc func(tx *DB) error, opts ...*sql.TxOptions) (err error) {
+	tx := db.WithContext(ctx).Begin(opts...)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err = fc(tx); err != nil {
+		return err
+	}
+	committed = true
+	return tx.Commit().Error
 }
@@ -0,0 +1,226 @@
+package zsql
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/luoskak/plant/pkg/rxjs"
+	"github.com/luoskak/plant/pkg/rxjs/abstract"
+	"github.com/luoskak/zsql/pkg/schema"
+)
+
+const (
+	changeFeedFunction = "zsql_notify_change"
+	changeFeedTrigger  = "zsql_change_feed"
+	changeFeedPrefix   = "zsql_changes_"
+)
+
+// 行变更超过NOTIFY上限时只发送op和table，ChangeEvent.Truncated为true
+const changeFeedFunctionSQL = `CREATE OR REPLACE FUNCTION ` + changeFeedFunction + `() RETURNS trigger AS $$
+DECLARE
+	payload text;
+BEGIN
+	payload := json_build_object(
+		'op', TG_OP,
+		'table', TG_TABLE_NAME,
+		'new', CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE row_to_json(NEW) END,
+		'old', CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE row_to_json(OLD) END
+	)::text;
+	IF octet_length(payload) >= 8000 THEN
+		payload := json_build_object('op', TG_OP, 'table', TG_TABLE_NAME, 'truncated', true)::text;
+	END IF;
+	PERFORM pg_notify(TG_ARGV[0], payload);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`
+
+// ChangeEvent 行级变更事件
+type ChangeEvent struct {
+	// Op INSERT UPDATE DELETE
+	Op    string
+	Table string
+	// New/Old 为模型类型的指针，INSERT时Old为nil，DELETE时New为nil
+	New interface{}
+	Old interface{}
+	// Truncated 行数据超过NOTIFY上限未发送，需自行查询
+	Truncated bool
+}
+
+type changePayload struct {
+	Op        string                     `json:"op"`
+	Table     string                     `json:"table"`
+	New       map[string]json.RawMessage `json:"new"`
+	Old       map[string]json.RawMessage `json:"old"`
+	Truncated bool                       `json:"truncated"`
+}
+
+// changeTabler 模型实现TableName()时以其作为变更订阅的表名，
+// 只用于change feed，不影响其他语句的表名
+type changeTabler interface {
+	TableName() string
+}
+
+// changeTable 模型对应的变更订阅表名
+func changeTable(sc *schema.Schema) string {
+	if tabler, ok := reflect.New(sc.ModelType).Interface().(changeTabler); ok {
+		return tabler.TableName()
+	}
+	return sc.Table
+}
+
+// ChangeChannel 模型表对应的通知频道，超过63字节时使用摘要
+func ChangeChannel(table string) string {
+	channel := changeFeedPrefix + table
+	if len(channel) > maxNotifyChannelLen {
+		sum := sha1.Sum([]byte(table))
+		channel = changeFeedPrefix + hex.EncodeToString(sum[:])[:16]
+	}
+	return channel
+}
+
+// InstallChangeFeed 安装通用触发器函数并在模型表上创建行级触发器
+func (db *DB) InstallChangeFeed(ctx context.Context, model interface{}) error {
+	table, err := db.changeFeedTable(model)
+	if err != nil {
+		return err
+	}
+	tx := db.contextSession(ctx).Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, statement := range changeFeedStatements(table) {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// changeFeedStatements 安装触发器的语句，频道作为触发器参数须为字符串字面量
+func changeFeedStatements(table string) []string {
+	return []string{
+		changeFeedFunctionSQL,
+		"DROP TRIGGER IF EXISTS " + changeFeedTrigger + " ON " + pgx.Identifier{table}.Sanitize(),
+		"CREATE TRIGGER " + changeFeedTrigger + " AFTER INSERT OR UPDATE OR DELETE ON " + pgx.Identifier{table}.Sanitize() +
+			" FOR EACH ROW EXECUTE PROCEDURE " + changeFeedFunction + "(" + quoteLiteral(ChangeChannel(table)) + ")",
+	}
+}
+
+// quoteLiteral 转为字符串字面量，其中的单引号加倍
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// RemoveChangeFeed 删除模型表上的触发器，触发器函数保留给其他表使用
+func (db *DB) RemoveChangeFeed(ctx context.Context, model interface{}) error {
+	table, err := db.changeFeedTable(model)
+	if err != nil {
+		return err
+	}
+	return db.contextSession(ctx).Exec("DROP TRIGGER IF EXISTS " + changeFeedTrigger + " ON " + pgx.Identifier{table}.Sanitize()).Error
+}
+
+// RemoveChangeFeedFunction 删除触发器函数及所有依赖它的触发器
+func (db *DB) RemoveChangeFeedFunction(ctx context.Context) error {
+	if db.dialect != "postgres" {
+		return ErrInvalidConnForListen
+	}
+	return db.contextSession(ctx).Exec("DROP FUNCTION IF EXISTS " + changeFeedFunction + "() CASCADE").Error
+}
+
+// Watch 订阅模型表的变更，发送*ChangeEvent，解码失败发送*NotificationError，
+// 重连后发送ListenReconnected
+func (db *DB) Watch(ctx context.Context, model interface{}) (abstract.Observable, error) {
+	tx := db.getInstance()
+	if err := tx.Statement.Parse(model); err != nil {
+		return nil, err
+	}
+	sc := tx.Statement.Schema
+	return tx.listen(ctx, ChangeChannel(changeTable(sc)), true, func(observer rxjs.Observer, n *pgconn.Notification) {
+		event, err := decodeChangeEvent(sc, []byte(n.Payload))
+		if err != nil {
+			observer.Next(&NotificationError{
+				Notification: &Notification{Channel: n.Channel, PID: n.PID, Payload: n.Payload},
+				Err:          err,
+			})
+			return
+		}
+		observer.Next(event)
+	})
+}
+
+func (db *DB) changeFeedTable(model interface{}) (string, error) {
+	if db.dialect != "postgres" {
+		return "", ErrInvalidConnForListen
+	}
+	sc, err := schema.Parse(model, db.opts.cacheStore, db.opts.namingStrategy)
+	if err != nil {
+		return "", err
+	}
+	return changeTable(sc), nil
+}
+
+func decodeChangeEvent(sc *schema.Schema, payload []byte) (*ChangeEvent, error) {
+	var p changePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+	event := &ChangeEvent{Op: p.Op, Table: p.Table, Truncated: p.Truncated}
+	var err error
+	if p.New != nil {
+		if event.New, err = decodeChangeRow(sc, p.New); err != nil {
+			return nil, err
+		}
+	}
+	if p.Old != nil {
+		if event.Old, err = decodeChangeRow(sc, p.Old); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// changeTimeLayouts row_to_json对timestamp不带时区
+var changeTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"}
+
+func decodeChangeRow(sc *schema.Schema, row map[string]json.RawMessage) (interface{}, error) {
+	elem := reflect.New(sc.ModelType)
+	for column, raw := range row {
+		field := sc.LookUpField(column)
+		if field == nil {
+			continue
+		}
+		typed := reflect.New(field.FieldType)
+		if err := json.Unmarshal(raw, typed.Interface()); err == nil {
+			if err := field.Set(elem, typed.Elem().Interface()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		if s, ok := v.(string); ok && field.DataType == schema.Time {
+			for _, layout := range changeTimeLayouts {
+				if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+					v = t
+					break
+				}
+			}
+		}
+		if err := field.Set(elem, v); err != nil {
+			return nil, fmt.Errorf("column %s: %w", column, err)
+		}
+	}
+	return elem.Interface(), nil
+}
@@ -0,0 +1,69 @@
+package zsql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/luoskak/zsql/internal/fakedb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeFeedStatements(t *testing.T) {
+	statements := changeFeedStatements("orders")
+	assert.Equal(t, `CREATE TRIGGER zsql_change_feed AFTER INSERT OR UPDATE OR DELETE ON "orders" FOR EACH ROW EXECUTE PROCEDURE zsql_notify_change('zsql_changes_orders')`, statements[2])
+
+	statements = changeFeedStatements("it's'); DROP TABLE users; --")
+	assert.Equal(t, `DROP TRIGGER IF EXISTS zsql_change_feed ON "it's'); DROP TABLE users; --"`, statements[1])
+	assert.Equal(t, `CREATE TRIGGER zsql_change_feed AFTER INSERT OR UPDATE OR DELETE ON "it's'); DROP TABLE users; --" FOR EACH ROW EXECUTE PROCEDURE zsql_notify_change('zsql_changes_it''s''); DROP TABLE users; --')`, statements[2])
+}
+
+type watchOrder struct {
+	ID    int64
+	State string
+}
+
+func TestChangeFeedKeepsCallerContext(t *testing.T) {
+	db, source := newFakeDB(nil)
+	db.dialect = "postgres"
+	type ctxKey struct{}
+	txCtx := context.WithValue(context.Background(), ctxKey{}, "tx")
+
+	tx := db.WithContext(txCtx).Begin()
+	assert.Nil(t, tx.Error)
+	assert.Nil(t, tx.RemoveChangeFeed(context.Background(), &watchOrder{}))
+	assert.Nil(t, tx.RemoveChangeFeedFunction(context.Background()))
+	assert.Equal(t, txCtx, tx.Statement.Context)
+	assert.Nil(t, tx.Commit().Error)
+
+	assert.Equal(t, []string{
+		fakedb.Begin,
+		`DROP TRIGGER IF EXISTS zsql_change_feed ON "watchOrder"`,
+		"DROP FUNCTION IF EXISTS zsql_notify_change() CASCADE",
+		fakedb.Commit,
+	}, source.SQL())
+
+	assert.Nil(t, db.InstallChangeFeed(context.Background(), &watchOrder{}))
+	sqls := source.SQL()[4:]
+	assert.Equal(t, fakedb.Begin, sqls[0])
+	assert.Equal(t, fakedb.Commit, sqls[len(sqls)-1])
+}
+
+type watchInvoice struct {
+	ID int64
+}
+
+func (watchInvoice) TableName() string {
+	return "invoices"
+}
+
+func TestChangeFeedTableName(t *testing.T) {
+	db, source := newFakeDB(nil)
+	db.dialect = "postgres"
+	assert.Nil(t, db.RemoveChangeFeed(context.Background(), &watchInvoice{}))
+	assert.Equal(t, []string{`DROP TRIGGER IF EXISTS zsql_change_feed ON "invoices"`}, source.SQL())
+
+	// TableName只用于change feed，模型的表名不变
+	tx := db.Query("SELECT * FROM x")
+	assert.Nil(t, tx.Statement.Parse(&watchInvoice{}))
+	assert.Equal(t, "watchInvoice", tx.Statement.Table)
+}